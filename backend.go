@@ -1,49 +1,277 @@
 package houdini
 
 import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"code.cloudfoundry.org/garden"
+	"code.cloudfoundry.org/lager"
 	"github.com/charlievieth/fs"
+	"github.com/vito/houdini/process"
 )
 
+type HandleExistsError struct {
+	Handle string
+}
+
+func (err HandleExistsError) Error() string {
+	return fmt.Sprintf("handle already exists: %s", err.Handle)
+}
+
 type Backend struct {
+	logger lager.Logger
+
 	containersDir string
 
+	shimPath string
+
+	maxContainers uint64
+
+	rootfsProviders  map[string]RootFSProvider
+	overlayRawRootfs bool
+
+	isolate bool
+
+	// where containers' cgroups go, if anywhere
+	cgroupRoot string
+
+	// the block device of the depot's filesystem, if it has project quotas
+	// enabled for limiting containers' disk usage
+	quotaDevice string
+
+	// the project ID most recently given to a container's disk quota
+	lastProject uint32
+
+	rootfsCache     *rootfsCache
+	rootfsCacheSize uint64
+
 	containers  map[string]*container
 	containersL sync.RWMutex
 
 	containerNum uint32
 }
 
-func NewBackend(containersDir string) *Backend {
-	return &Backend{
+// the project ID containers' disk quotas are numbered from, unless the depot
+// directory has a project ID of its own
+const defaultQuotaProject = 1 << 20
+
+// how many containers to destroy at once when stopping
+const maxConcurrentDestroys = 8
+
+type BackendOption func(*Backend)
+
+func WithLogger(logger lager.Logger) BackendOption {
+	return func(backend *Backend) {
+		backend.logger = logger
+	}
+}
+
+// WithMaxContainers limits the number of containers that may exist at once.
+// By default, or with 0, there is no limit.
+func WithMaxContainers(maxContainers uint64) BackendOption {
+	return func(backend *Backend) {
+		backend.maxContainers = maxContainers
+	}
+}
+
+// WithRootfsCacheSize limits how much disk the cache of unpacked tarball and
+// image rootfses may use. Rootfses no container is using are evicted once the
+// cache is bigger than this.
+func WithRootfsCacheSize(size uint64) BackendOption {
+	return func(backend *Backend) {
+		backend.rootfsCacheSize = size
+	}
+}
+
+// WithRawRootfsOverlay gives every container with a raw:// rootfs an overlay
+// of it, as if it had set OverlayProperty.
+func WithRawRootfsOverlay() BackendOption {
+	return func(backend *Backend) {
+		backend.overlayRawRootfs = true
+	}
+}
+
+// WithIsolation runs the processes of every container in namespaces of the
+// container's own, as if each container had set IsolationProperty.
+func WithIsolation() BackendOption {
+	return func(backend *Backend) {
+		backend.isolate = true
+	}
+}
+
+// WithCgroupRoot gives each container a cgroup beneath root, a cgroup v2
+// directory delegated to the server, through which its limits are enforced
+// (on Linux only).
+func WithCgroupRoot(root string) BackendOption {
+	return func(backend *Backend) {
+		backend.cgroupRoot = root
+	}
+}
+
+// WithShim runs every process through the shim binary at shimPath, so that
+// processes keep running when the server restarts and can be reattached to
+// afterwards.
+func WithShim(shimPath string) BackendOption {
+	return func(backend *Backend) {
+		backend.shimPath = shimPath
+	}
+}
+
+func NewBackend(containersDir string, opts ...BackendOption) *Backend {
+	backend := &Backend{
+		logger: lager.NewLogger("houdini"),
+
 		containersDir: containersDir,
 
 		containers: make(map[string]*container),
 
+		rootfsProviders: make(map[string]RootFSProvider),
+
 		containerNum: uint32(time.Now().UnixNano()),
+
+		rootfsCacheSize: DefaultRootfsCacheSize,
+	}
+
+	for _, opt := range opts {
+		opt(backend)
+	}
+
+	backend.rootfsCache = newRootfsCache(
+		backend.logger.Session("rootfs-cache"),
+		filepath.Join(containersDir, rootfsCacheDirName),
+		backend.rootfsCacheSize,
+	)
+
+	archives := cachedRootFSProvider{cache: backend.rootfsCache, resolve: newArchiveResolver().resolve}
+
+	builtinProviders := map[string]RootFSProvider{
+		"raw":  rawRootFSProvider{overlay: backend.overlayRawRootfs},
+		"tar":  archives,
+		"file": archives,
+		"oci":  cachedRootFSProvider{cache: backend.rootfsCache, resolve: resolveOCIImage},
+	}
+
+	for scheme, provider := range builtinProviders {
+		_, found := backend.rootfsProviders[scheme]
+		if !found {
+			backend.rootfsProviders[scheme] = provider
+		}
 	}
+
+	return backend
 }
 
 func (backend *Backend) Start() error {
-	return fs.MkdirAll(backend.containersDir, 0755)
-}
+	err := fs.MkdirAll(backend.containersDir, 0755)
+	if err != nil {
+		return err
+	}
 
-func (backend *Backend) Stop() error {
-	containers, err := backend.Containers(nil)
+	if backend.cgroupRoot != "" {
+		err := enableCgroupControllers(backend.cgroupRoot)
+		if err != nil {
+			return err
+		}
+	}
+
+	backend.quotaDevice, err = projectQuotaDevice(backend.containersDir)
 	if err != nil {
 		return err
 	}
 
-	for _, container := range containers {
-		err = backend.Destroy(container.Handle())
+	if backend.quotaDevice != "" {
+		// an operator can keep containers' project IDs clear of any others on
+		// the filesystem by giving the depot one
+		backend.lastProject, err = dirProject(backend.containersDir)
 		if err != nil {
 			return err
 		}
+
+		if backend.lastProject == 0 {
+			backend.lastProject = defaultQuotaProject
+		}
+	}
+
+	err = backend.restoreContainers()
+	if err != nil {
+		return err
+	}
+
+	return backend.collectGarbage()
+}
+
+func (backend *Backend) Stop() error {
+	if backend.shimPath != "" {
+		// the processes outlive the server through their shims, so leave the
+		// containers for the next server to pick up
+		return backend.detach()
+	}
+
+	// destroy everything, including containers that failed to be destroyed
+	// before
+	handles := []string{}
+
+	backend.containersL.RLock()
+	for handle, container := range backend.containers {
+		if container.currentLifecycle() != lifecycleCreating {
+			handles = append(handles, handle)
+		}
+	}
+	backend.containersL.RUnlock()
+
+	queue := make(chan string)
+	go func() {
+		for _, handle := range handles {
+			queue <- handle
+		}
+
+		close(queue)
+	}()
+
+	var errs []error
+	errsL := new(sync.Mutex)
+
+	wg := new(sync.WaitGroup)
+	for i := 0; i < maxConcurrentDestroys; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for handle := range queue {
+				err := backend.Destroy(handle)
+				if err != nil {
+					errsL.Lock()
+					errs = append(errs, fmt.Errorf("failed to destroy %s: %w", handle, err))
+					errsL.Unlock()
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+// detach lets go of every container without destroying it.
+func (backend *Backend) detach() error {
+	backend.containersL.RLock()
+	defer backend.containersL.RUnlock()
+
+	for handle, container := range backend.containers {
+		err := container.detach()
+		if err != nil {
+			return fmt.Errorf("failed to detach from %s: %w", handle, err)
+		}
 	}
 
 	return nil
@@ -58,8 +286,22 @@ func (backend *Backend) Ping() error {
 }
 
 func (backend *Backend) Capacity() (garden.Capacity, error) {
-	println("NOT IMPLEMENTED: Capacity")
-	return garden.Capacity{}, nil
+	memory, err := totalMemory()
+	if err != nil {
+		return garden.Capacity{}, err
+	}
+
+	diskTotal, diskFree, err := diskSpace(backend.containersDir)
+	if err != nil {
+		return garden.Capacity{}, err
+	}
+
+	return garden.Capacity{
+		MemoryInBytes:          memory,
+		DiskInBytes:            diskTotal,
+		SchedulableDiskInBytes: diskFree,
+		MaxContainers:          backend.maxContainers,
+	}, nil
 }
 
 func (backend *Backend) Create(spec garden.ContainerSpec) (garden.Container, error) {
@@ -74,42 +316,73 @@ func (backend *Backend) Create(spec garden.ContainerSpec) (garden.Container, err
 		return nil, err
 	}
 
-	err = container.setup()
+	err = backend.register(container)
 	if err != nil {
 		return nil, err
 	}
 
-	backend.containersL.Lock()
-	backend.containers[spec.Handle] = container
-	backend.containersL.Unlock()
+	err = container.create()
+	if err != nil {
+		container.cleanup()
+
+		backend.containersL.Lock()
+		delete(backend.containers, spec.Handle)
+		backend.containersL.Unlock()
+
+		return nil, err
+	}
 
 	return container, nil
 }
 
+// register claims the container's handle while it is being created, so that
+// concurrent creates with the same handle fail.
+func (backend *Backend) register(container *container) error {
+	backend.containersL.Lock()
+	defer backend.containersL.Unlock()
+
+	_, found := backend.containers[container.handle]
+	if found {
+		return HandleExistsError{Handle: container.handle}
+	}
+
+	if backend.maxContainers != 0 && uint64(len(backend.containers)) >= backend.maxContainers {
+		return fmt.Errorf("cannot create more than %d containers", backend.maxContainers)
+	}
+
+	backend.containers[container.handle] = container
+
+	return nil
+}
+
 func (backend *Backend) Destroy(handle string) error {
 	backend.containersL.RLock()
 	container, found := backend.containers[handle]
 	backend.containersL.RUnlock()
 
-	if !found {
+	if !found || container.currentLifecycle() == lifecycleCreating {
 		return garden.ContainerNotFoundError{Handle: handle}
 	}
 
-	err := container.Stop(false)
-	if err != nil {
-		return err
+	attempt, inProgress := container.startDestroying()
+	if inProgress {
+		<-attempt.done
+		return attempt.err
 	}
 
-	err = container.cleanup()
-	if err != nil {
-		return err
+	// if this fails, the container stays around (but unlisted) in its current
+	// state, so that destroying it can be retried
+	attempt.err = container.destroy()
+
+	if attempt.err == nil {
+		backend.containersL.Lock()
+		delete(backend.containers, handle)
+		backend.containersL.Unlock()
 	}
 
-	backend.containersL.Lock()
-	delete(backend.containers, handle)
-	backend.containersL.Unlock()
+	container.finishDestroying(attempt)
 
-	return nil
+	return attempt.err
 }
 
 func (backend *Backend) Containers(filter garden.Properties) ([]garden.Container, error) {
@@ -118,6 +391,10 @@ func (backend *Backend) Containers(filter garden.Properties) ([]garden.Container
 	backend.containersL.RLock()
 
 	for _, container := range backend.containers {
+		if container.currentLifecycle() != lifecycleActive {
+			continue
+		}
+
 		if containerHasProperties(container, filter) {
 			matchingContainers = append(matchingContainers, container)
 		}
@@ -129,11 +406,47 @@ func (backend *Backend) Containers(filter garden.Properties) ([]garden.Container
 }
 
 func (backend *Backend) BulkInfo(handles []string) (map[string]garden.ContainerInfoEntry, error) {
-	return map[string]garden.ContainerInfoEntry{}, nil
+	infos := map[string]garden.ContainerInfoEntry{}
+
+	for _, handle := range handles {
+		container, err := backend.Lookup(handle)
+		if err != nil {
+			infos[handle] = garden.ContainerInfoEntry{Err: &garden.Error{Err: err}}
+			continue
+		}
+
+		info, err := container.Info()
+		if err != nil {
+			infos[handle] = garden.ContainerInfoEntry{Err: &garden.Error{Err: err}}
+			continue
+		}
+
+		infos[handle] = garden.ContainerInfoEntry{Info: info}
+	}
+
+	return infos, nil
 }
 
 func (backend *Backend) BulkMetrics(handles []string) (map[string]garden.ContainerMetricsEntry, error) {
-	return map[string]garden.ContainerMetricsEntry{}, nil
+	metrics := map[string]garden.ContainerMetricsEntry{}
+
+	for _, handle := range handles {
+		container, err := backend.Lookup(handle)
+		if err != nil {
+			metrics[handle] = garden.ContainerMetricsEntry{Err: &garden.Error{Err: err}}
+			continue
+		}
+
+		containerMetrics, err := container.Metrics()
+		if err != nil {
+			metrics[handle] = garden.ContainerMetricsEntry{Err: &garden.Error{Err: err}}
+			continue
+		}
+
+		metrics[handle] = garden.ContainerMetricsEntry{Metrics: containerMetrics}
+	}
+
+	return metrics, nil
 }
 
 func (backend *Backend) Lookup(handle string) (garden.Container, error) {
@@ -141,13 +454,229 @@ func (backend *Backend) Lookup(handle string) (garden.Container, error) {
 	container, found := backend.containers[handle]
 	backend.containersL.RUnlock()
 
-	if !found {
+	if !found || container.currentLifecycle() != lifecycleActive {
 		return nil, garden.ContainerNotFoundError{Handle: handle}
 	}
 
 	return container, nil
 }
 
+func (backend *Backend) restoreContainers() error {
+	entries, err := os.ReadDir(backend.containersDir)
+	if err != nil {
+		return err
+	}
+
+	unfinished := []string{}
+
+	backend.containersL.Lock()
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		container, err := backend.restoreContainer(entry.Name())
+		if err != nil {
+			if !os.IsNotExist(err) {
+				backend.logger.Error("failed-to-restore-container", err, lager.Data{
+					"id": entry.Name(),
+				})
+			}
+
+			// no usable state; it'll be garbage collected
+			continue
+		}
+
+		switch container.currentLifecycle() {
+		case lifecycleCreating:
+			// never finished creating
+			continue
+		case lifecycleStopping, lifecycleDestroying:
+			unfinished = append(unfinished, container.Handle())
+		}
+
+		backend.containers[container.Handle()] = container
+
+		if container.quota != nil && container.quota.project > backend.lastProject {
+			backend.lastProject = container.quota.project
+		}
+	}
+
+	backend.containersL.Unlock()
+
+	for _, handle := range unfinished {
+		// a failure here leaves the container to be destroyed again later, just
+		// like any other failed destroy
+		err := backend.Destroy(handle)
+		if err != nil {
+			backend.logger.Error("failed-to-finish-destroying-container", err, lager.Data{
+				"handle": handle,
+			})
+		}
+	}
+
+	return nil
+}
+
+// collectGarbage removes everything in the depot that doesn't belong to a
+// container, e.g. containers that were left half-created by a crash.
+func (backend *Backend) collectGarbage() error {
+	entries, err := os.ReadDir(backend.containersDir)
+	if err != nil {
+		return err
+	}
+
+	ids := map[string]bool{}
+
+	backend.containersL.RLock()
+	for _, container := range backend.containers {
+		ids[container.id] = true
+	}
+	backend.containersL.RUnlock()
+
+	for _, entry := range entries {
+		if !entry.IsDir() || ids[entry.Name()] || entry.Name() == rootfsCacheDirName {
+			continue
+		}
+
+		dir := filepath.Join(backend.containersDir, entry.Name())
+
+		logData := lager.Data{"id": entry.Name()}
+
+		state, err := loadState(dir)
+		if err == nil {
+			logData["handle"] = state.Spec.Handle
+		}
+
+		logger := backend.logger.Session("collect-garbage", logData)
+
+		// only containers that never finished being created are garbage; one
+		// that couldn't be restored, e.g. because its state couldn't be read,
+		// is left alone in case it can be next time
+		if (err != nil && !os.IsNotExist(err)) || (err == nil && state.Lifecycle != lifecycleCreating) {
+			logger.Info("leaving-unrestored-container")
+
+			// nor is the rootfs it uses garbage
+			ids[entry.Name()] = true
+
+			continue
+		}
+
+		// kill anything the container left running before its mounts go away
+		err = state.Init.kill()
+		if err != nil {
+			logger.Error("failed-to-kill-init", err)
+			continue
+		}
+
+		if state.Cgroup != "" {
+			cgroup := &cgroup{dir: state.Cgroup}
+
+			err := cgroup.destroy()
+			if err != nil {
+				logger.Error("failed-to-destroy-cgroup", err)
+				continue
+			}
+		}
+
+		// let the project ID be reused without the container's limits
+		quota := backend.restoredQuota(state.Project)
+		if quota != nil {
+			err := quota.destroy()
+			if err != nil {
+				logger.Error("failed-to-destroy-disk-quota", err)
+			}
+		}
+
+		// the container may have mounted things outside of the depot, e.g. into
+		// a raw rootfs
+		for i := len(state.Mounts) - 1; i >= 0; i-- {
+			err := unmount(state.Mounts[i])
+			if err != nil {
+				logger.Error("failed-to-unmount", err)
+			}
+		}
+
+		err = unmountBeneath(dir)
+		if err != nil {
+			logger.Error("failed-to-unmount", err)
+			continue
+		}
+
+		err = fs.RemoveAll(dir)
+		if err != nil {
+			logger.Error("failed-to-remove", err)
+			continue
+		}
+
+		logger.Info("removed")
+	}
+
+	// forget about the containers that were just removed
+	err = backend.rootfsCache.Prune(ids)
+	if err != nil {
+		backend.logger.Error("failed-to-prune-rootfs-cache", err)
+	}
+
+	return nil
+}
+
+func (backend *Backend) newProcessTracker(dir string) process.ProcessTracker {
+	processesDir := filepath.Join(dir, "processes")
+
+	if backend.shimPath != "" {
+		return process.NewShimTracker(processesDir, backend.shimPath)
+	}
+
+	return process.NewTracker(processesDir)
+}
+
+// containerCgroup is the cgroup for the container with the given ID, or nil
+// if containers don't get cgroups.
+func (backend *Backend) containerCgroup(id string) *cgroup {
+	if backend.cgroupRoot == "" {
+		return nil
+	}
+
+	return &cgroup{dir: filepath.Join(backend.cgroupRoot, id)}
+}
+
+// containerQuota allocates a project quota for a new container, or returns
+// nil if the depot's filesystem doesn't have project quotas.
+func (backend *Backend) containerQuota() *diskQuota {
+	if backend.quotaDevice == "" {
+		return nil
+	}
+
+	return &diskQuota{
+		device:  backend.quotaDevice,
+		project: atomic.AddUint32(&backend.lastProject, 1),
+	}
+}
+
+// restoredQuota is the project quota of a container being restored, or nil if
+// it has none.
+func (backend *Backend) restoredQuota(project uint32) *diskQuota {
+	if project == 0 || backend.quotaDevice == "" {
+		return nil
+	}
+
+	return &diskQuota{device: backend.quotaDevice, project: project}
+}
+
+// rootfsSchemes describes the rootfs URIs the backend supports, for errors.
+func (backend *Backend) rootfsSchemes() string {
+	schemes := []string{}
+	for scheme := range backend.rootfsProviders {
+		schemes = append(schemes, scheme+"://")
+	}
+
+	sort.Strings(schemes)
+
+	return strings.Join(schemes, ", ")
+}
+
 func (backend *Backend) generateContainerID() string {
 	containerNum := atomic.AddUint32(&backend.containerNum, 1)
 
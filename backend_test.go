@@ -0,0 +1,446 @@
+package houdini_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/garden"
+	"github.com/vito/houdini"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+)
+
+var _ = Describe("Backend", func() {
+	Describe("restarting", func() {
+		var container garden.Container
+
+		BeforeEach(func() {
+			var err error
+			container, err = backend.Create(garden.ContainerSpec{
+				Handle:     "some-handle",
+				Properties: garden.Properties{"a": "b"},
+				Env:        []string{"FOO=bar"},
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(container.SetProperty("c", "d")).To(Succeed())
+			Expect(container.SetGraceTime(time.Minute)).To(Succeed())
+		})
+
+		It("restores containers from the depot", func() {
+			restarted := restartBackend()
+
+			restored, err := restarted.Lookup("some-handle")
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(restored.Properties()).To(Equal(garden.Properties{
+				"a": "b",
+				"c": "d",
+			}))
+
+			Expect(restarted.GraceTime(restored)).To(Equal(time.Minute))
+
+			containers, err := restarted.Containers(garden.Properties{"c": "d"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(containers).To(HaveLen(1))
+
+			process, err := restored.Run(garden.ProcessSpec{
+				Path: "sh",
+				Args: []string{"-c", `test "$FOO" = bar`},
+			}, garden.ProcessIO{
+				Stdout: GinkgoWriter,
+				Stderr: GinkgoWriter,
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(process.Wait()).To(Equal(0))
+		})
+
+		It("removes leftovers that don't belong to a container", func() {
+			orphan := filepath.Join(depotDir, "some-orphan")
+			Expect(os.MkdirAll(filepath.Join(orphan, "workdir"), 0755)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(orphan, "workdir", "some-file"), []byte("hi"), 0644)).To(Succeed())
+
+			restartBackend()
+
+			Expect(orphan).ToNot(BeADirectory())
+
+			info, err := container.Info()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(info.ContainerPath).To(BeADirectory())
+		})
+
+		It("removes containers that never finished being created", func() {
+			halfCreated := filepath.Join(depotDir, "some-half-created")
+			Expect(os.MkdirAll(filepath.Join(halfCreated, "workdir"), 0755)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(halfCreated, "state.json"), []byte(`{"lifecycle":"creating"}`), 0644)).To(Succeed())
+
+			restartBackend()
+
+			Expect(halfCreated).ToNot(BeADirectory())
+		})
+
+		It("leaves containers that can't be restored where they are", func() {
+			unreadable := filepath.Join(depotDir, "some-unreadable")
+			Expect(os.MkdirAll(filepath.Join(unreadable, "workdir"), 0755)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(unreadable, "state.json"), []byte("{"), 0644)).To(Succeed())
+
+			restartBackend()
+
+			Expect(filepath.Join(unreadable, "workdir")).To(BeADirectory())
+		})
+
+		Context("with a shim", func() {
+			var shimBackend *houdini.Backend
+
+			BeforeEach(func() {
+				shimBackend = houdini.NewBackend(depotDir, houdini.WithShim(shimPath))
+				Expect(shimBackend.Start()).To(Succeed())
+
+				var err error
+				container, err = shimBackend.Create(garden.ContainerSpec{
+					Handle: "some-shimmed-handle",
+				})
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			AfterEach(func() {
+				// stopping leaves the container running
+				Expect(shimBackend.Destroy(container.Handle())).To(Succeed())
+				Expect(shimBackend.Stop()).To(Succeed())
+			})
+
+			It("streams stdio and reports the exit status", func() {
+				stdout := gbytes.NewBuffer()
+
+				process, err := container.Run(garden.ProcessSpec{
+					Path: "sh",
+					Args: []string{"-c", "read x; echo hello $x; exit 3"},
+				}, garden.ProcessIO{
+					Stdin:  strings.NewReader("world\n"),
+					Stdout: stdout,
+					Stderr: GinkgoWriter,
+				})
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(process.Wait()).To(Equal(3))
+				Expect(stdout).To(gbytes.Say("hello world"))
+			})
+
+			It("streams the output of processes that exit right away", func() {
+				for i := 0; i < 20; i++ {
+					stdout := gbytes.NewBuffer()
+
+					process, err := container.Run(garden.ProcessSpec{
+						Path: "echo",
+						Args: []string{"hello"},
+					}, garden.ProcessIO{
+						Stdout: stdout,
+						Stderr: GinkgoWriter,
+					})
+					Expect(err).ToNot(HaveOccurred())
+
+					Expect(process.Wait()).To(Equal(0))
+					Expect(stdout).To(gbytes.Say("hello\n"))
+				}
+			})
+
+			It("leaves containers and their processes running when stopped", func() {
+				_, err := container.Run(garden.ProcessSpec{
+					ID:   "some-process",
+					Path: "sh",
+					Args: []string{"-c", "read x; echo hello $x; exit 3"},
+				}, garden.ProcessIO{})
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(shimBackend.Stop()).To(Succeed())
+
+				restarted := restartBackend(houdini.WithShim(shimPath))
+
+				restored, err := restarted.Lookup("some-shimmed-handle")
+				Expect(err).ToNot(HaveOccurred())
+
+				stdout := gbytes.NewBuffer()
+
+				process, err := restored.Attach("some-process", garden.ProcessIO{
+					Stdin:  strings.NewReader("again\n"),
+					Stdout: stdout,
+				})
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(process.Wait()).To(Equal(3))
+				Eventually(stdout).Should(gbytes.Say("hello again"))
+			})
+
+			It("reattaches to processes that are still running", func() {
+				_, err := container.Run(garden.ProcessSpec{
+					ID:   "some-process",
+					Path: "sh",
+					Args: []string{"-c", "read x; echo hello $x; exit 3"},
+				}, garden.ProcessIO{})
+				Expect(err).ToNot(HaveOccurred())
+
+				restarted := restartBackend(houdini.WithShim(shimPath))
+
+				restored, err := restarted.Lookup("some-shimmed-handle")
+				Expect(err).ToNot(HaveOccurred())
+
+				stdout := gbytes.NewBuffer()
+
+				process, err := restored.Attach("some-process", garden.ProcessIO{
+					Stdin:  strings.NewReader("again\n"),
+					Stdout: stdout,
+				})
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(process.Wait()).To(Equal(3))
+				Expect(stdout).To(gbytes.Say("hello again"))
+			})
+		})
+	})
+
+	Describe("Create", func() {
+		It("refuses to reuse a handle", func() {
+			_, err := backend.Create(garden.ContainerSpec{Handle: "some-handle"})
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = backend.Create(garden.ContainerSpec{Handle: "some-handle"})
+			Expect(err).To(Equal(houdini.HandleExistsError{Handle: "some-handle"}))
+		})
+
+		It("refuses a spec with both a rootfs path and an image", func() {
+			_, err := backend.Create(garden.ContainerSpec{
+				RootFSPath: "raw:///some/rootfs",
+				Image:      garden.ImageRef{URI: "raw:///some/other/rootfs"},
+			})
+			Expect(err).To(MatchError(ContainSubstring("both")))
+		})
+
+		It("refuses images it can't serve", func() {
+			_, err := backend.Create(garden.ContainerSpec{
+				Image: garden.ImageRef{URI: "docker:///busybox"},
+			})
+			Expect(err).To(MatchError(ContainSubstring("unsupported rootfs uri")))
+		})
+
+		It("refuses an invalid CPU quota", func() {
+			_, err := backend.Create(garden.ContainerSpec{
+				Properties: garden.Properties{houdini.CPUQuotaProperty: "lots"},
+			})
+			Expect(err).To(MatchError(ContainSubstring("invalid houdini.cpu-quota")))
+		})
+
+		It("allows only one of many concurrent creates with the same handle", func() {
+			errs := make(chan error, 10)
+			for i := 0; i < cap(errs); i++ {
+				go func() {
+					defer GinkgoRecover()
+					_, err := backend.Create(garden.ContainerSpec{Handle: "some-handle"})
+					errs <- err
+				}()
+			}
+
+			succeeded := 0
+			for i := 0; i < cap(errs); i++ {
+				err := <-errs
+				if err == nil {
+					succeeded++
+				} else {
+					Expect(err).To(Equal(houdini.HandleExistsError{Handle: "some-handle"}))
+				}
+			}
+
+			Expect(succeeded).To(Equal(1))
+		})
+	})
+
+	Describe("Destroy", func() {
+		It("lets concurrent destroys of the same container all succeed", func() {
+			container, err := backend.Create(garden.ContainerSpec{})
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = container.Run(garden.ProcessSpec{
+				Path: "sleep",
+				Args: []string{"10"},
+			}, garden.ProcessIO{})
+			Expect(err).ToNot(HaveOccurred())
+
+			errs := make(chan error, 10)
+			for i := 0; i < cap(errs); i++ {
+				go func() {
+					errs <- backend.Destroy(container.Handle())
+				}()
+			}
+
+			for i := 0; i < cap(errs); i++ {
+				err := <-errs
+				if err != nil {
+					// a destroy that came along after the others finished
+					Expect(err).To(Equal(garden.ContainerNotFoundError{Handle: container.Handle()}))
+				}
+			}
+
+			_, err = backend.Lookup(container.Handle())
+			Expect(err).To(HaveOccurred())
+
+			_, err = container.Run(garden.ProcessSpec{Path: "true"}, garden.ProcessIO{})
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("Stop", func() {
+		It("destroys every container", func() {
+			for i := 0; i < 10; i++ {
+				container, err := backend.Create(garden.ContainerSpec{})
+				Expect(err).ToNot(HaveOccurred())
+
+				_, err = container.Run(garden.ProcessSpec{
+					Path: "sleep",
+					Args: []string{"10"},
+				}, garden.ProcessIO{})
+				Expect(err).ToNot(HaveOccurred())
+			}
+
+			Expect(backend.Stop()).To(Succeed())
+
+			Expect(backend.Containers(nil)).To(BeEmpty())
+
+			entries, err := os.ReadDir(depotDir)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(entries).To(BeEmpty())
+		})
+
+		It("destroys the rest of the containers when one fails to be destroyed, and names it", func() {
+			rootfs, err := os.MkdirTemp("", "rootfs")
+			Expect(err).ToNot(HaveOccurred())
+
+			DeferCleanup(os.RemoveAll, rootfs)
+
+			Expect(backend.Stop()).To(Succeed())
+
+			backend = houdini.NewBackend(depotDir, houdini.WithRootFSProvider("broken", brokenRootFSProvider{path: rootfs}))
+			Expect(backend.Start()).To(Succeed())
+
+			_, err = backend.Create(garden.ContainerSpec{
+				Handle:     "some-broken-handle",
+				RootFSPath: "broken:///some-rootfs",
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			processes := []garden.Process{}
+			for i := 0; i < 10; i++ {
+				container, err := backend.Create(garden.ContainerSpec{})
+				Expect(err).ToNot(HaveOccurred())
+
+				process, err := container.Run(garden.ProcessSpec{
+					Path: "sleep",
+					Args: []string{"10"},
+				}, garden.ProcessIO{})
+				Expect(err).ToNot(HaveOccurred())
+
+				processes = append(processes, process)
+			}
+
+			err = backend.Stop()
+			Expect(err).To(MatchError(ContainSubstring("failed to destroy some-broken-handle")))
+			Expect(err).To(MatchError(ContainSubstring("rootfs is stuck")))
+
+			for _, process := range processes {
+				_, err := process.Wait()
+				Expect(err).ToNot(HaveOccurred())
+			}
+
+			Expect(backend.Containers(nil)).To(BeEmpty())
+
+			// only the container that failed to be destroyed is left
+			entries, err := os.ReadDir(depotDir)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(entries).To(HaveLen(1))
+		})
+	})
+
+	Describe("GraceTime", func() {
+		It("starts out as the grace time from the spec", func() {
+			container, err := backend.Create(garden.ContainerSpec{
+				GraceTime: time.Second,
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(backend.GraceTime(container)).To(Equal(time.Second))
+
+			Expect(container.SetGraceTime(time.Minute)).To(Succeed())
+			Expect(backend.GraceTime(container)).To(Equal(time.Minute))
+		})
+	})
+
+	Describe("Capacity", func() {
+		It("reports the host's memory and disk, and the max containers", func() {
+			capacity, err := backend.Capacity()
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(capacity.MemoryInBytes).To(BeNumerically(">", 0))
+			Expect(capacity.DiskInBytes).To(BeNumerically(">", 0))
+			Expect(capacity.SchedulableDiskInBytes).To(BeNumerically("<=", capacity.DiskInBytes))
+			Expect(capacity.MaxContainers).To(BeZero())
+		})
+
+		It("reports the max containers it's limited to", func() {
+			limited := houdini.NewBackend(depotDir, houdini.WithMaxContainers(10))
+			Expect(limited.Start()).To(Succeed())
+
+			capacity, err := limited.Capacity()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(capacity.MaxContainers).To(Equal(uint64(10)))
+
+			Expect(limited.Stop()).To(Succeed())
+		})
+
+		It("refuses to create more than the max containers", func() {
+			limited := houdini.NewBackend(depotDir, houdini.WithMaxContainers(1))
+			Expect(limited.Start()).To(Succeed())
+
+			_, err := limited.Create(garden.ContainerSpec{})
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = limited.Create(garden.ContainerSpec{})
+			Expect(err).To(HaveOccurred())
+
+			Expect(limited.Stop()).To(Succeed())
+		})
+	})
+
+	Describe("BulkInfo", func() {
+		It("returns info for each handle, and an error for unknown handles", func() {
+			_, err := backend.Create(garden.ContainerSpec{Handle: "some-handle"})
+			Expect(err).ToNot(HaveOccurred())
+
+			infos, err := backend.BulkInfo([]string{"some-handle", "bogus-handle"})
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(infos).To(HaveKey("some-handle"))
+			Expect(infos["some-handle"].Err).To(BeNil())
+			Expect(infos["some-handle"].Info.State).To(Equal("active"))
+
+			Expect(infos).To(HaveKey("bogus-handle"))
+			Expect(infos["bogus-handle"].Err.Err).To(Equal(garden.ContainerNotFoundError{Handle: "bogus-handle"}))
+		})
+	})
+})
+
+// brokenRootFSProvider provides the rootfs at path, which it then fails to
+// clean up after.
+type brokenRootFSProvider struct {
+	path string
+}
+
+func (provider brokenRootFSProvider) Create(houdini.RootFSSpec) (houdini.RootFS, error) {
+	return houdini.RootFS{Path: provider.path}, nil
+}
+
+func (provider brokenRootFSProvider) Destroy(houdini.RootFSSpec) error {
+	return errors.New("rootfs is stuck")
+}
@@ -0,0 +1,88 @@
+// +build !windows
+
+package houdini_test
+
+import (
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/garden"
+	houdiniprocess "github.com/vito/houdini/process"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Backend on Unix", func() {
+	Describe("restarting", func() {
+		var container garden.Container
+
+		BeforeEach(func() {
+			var err error
+			container, err = backend.Create(garden.ContainerSpec{Handle: "some-handle"})
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("restores processes that are still running", func() {
+			process, err := container.Run(garden.ProcessSpec{
+				ID:   "some-process",
+				Path: "sleep",
+				Args: []string{"10"},
+			}, garden.ProcessIO{})
+			Expect(err).ToNot(HaveOccurred())
+
+			restarted := restartBackend()
+
+			restored, err := restarted.Lookup("some-handle")
+			Expect(err).ToNot(HaveOccurred())
+
+			restoredProcess, err := restored.Attach("some-process", garden.ProcessIO{})
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(restoredProcess.Signal(garden.SignalKill)).To(Succeed())
+
+			_, err = process.Wait()
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = restoredProcess.Wait()
+			Expect(err).To(Equal(houdiniprocess.ErrUnknownExitStatus))
+		})
+
+		It("leaves processes alone once their pid is some other process's", func() {
+			process, err := container.Run(garden.ProcessSpec{
+				ID:   "some-process",
+				Path: "sleep",
+				Args: []string{"10"},
+			}, garden.ProcessIO{})
+			Expect(err).ToNot(HaveOccurred())
+
+			// as if the process had exited and its pid been given to the one
+			// that's running now
+			records, err := filepath.Glob(filepath.Join(depotDir, "*", "processes", "some-process", "started"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(records).To(HaveLen(1))
+			Expect(os.WriteFile(records[0], []byte("1000000000"), 0644)).To(Succeed())
+
+			restarted := restartBackend()
+
+			restored, err := restarted.Lookup("some-handle")
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = restored.Attach("some-process", garden.ProcessIO{})
+			Expect(err).To(MatchError(ContainSubstring("unknown process")))
+
+			Expect(restarted.Stop()).To(Succeed())
+
+			exited := make(chan struct{})
+			go func() {
+				process.Wait()
+				close(exited)
+			}()
+
+			Consistently(exited).ShouldNot(BeClosed())
+
+			Expect(process.Signal(garden.SignalKill)).To(Succeed())
+			Eventually(exited).Should(BeClosed())
+		})
+	})
+})
@@ -0,0 +1,17 @@
+package houdini
+
+import "golang.org/x/sys/unix"
+
+func totalMemory() (uint64, error) {
+	return unix.SysctlUint64("hw.memsize")
+}
+
+func diskSpace(dir string) (uint64, uint64, error) {
+	var stat unix.Statfs_t
+	err := unix.Statfs(dir, &stat)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return stat.Blocks * uint64(stat.Bsize), stat.Bavail * uint64(stat.Bsize), nil
+}
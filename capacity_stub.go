@@ -0,0 +1,14 @@
+// +build !linux,!darwin,!windows
+
+package houdini
+
+// capacity is not known on other platforms; report nothing rather than fail
+// to start
+
+func totalMemory() (uint64, error) {
+	return 0, nil
+}
+
+func diskSpace(dir string) (uint64, uint64, error) {
+	return 0, 0, nil
+}
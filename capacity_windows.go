@@ -0,0 +1,58 @@
+package houdini
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var kernel32 = syscall.NewLazyDLL("kernel32.dll")
+
+var procGlobalMemoryStatusEx = kernel32.NewProc("GlobalMemoryStatusEx")
+
+type memoryStatusEx struct {
+	Length               uint32
+	MemoryLoad           uint32
+	TotalPhys            uint64
+	AvailPhys            uint64
+	TotalPageFile        uint64
+	AvailPageFile        uint64
+	TotalVirtual         uint64
+	AvailVirtual         uint64
+	AvailExtendedVirtual uint64
+}
+
+func totalMemory() (uint64, error) {
+	status := memoryStatusEx{}
+	status.Length = uint32(unsafe.Sizeof(status))
+
+	r1, _, e1 := procGlobalMemoryStatusEx.Call(uintptr(unsafe.Pointer(&status)))
+	if r1 == 0 {
+		return 0, os.NewSyscallError("GlobalMemoryStatusEx", e1)
+	}
+
+	return status.TotalPhys, nil
+}
+
+var procGetDiskFreeSpaceExW = kernel32.NewProc("GetDiskFreeSpaceExW")
+
+func diskSpace(dir string) (uint64, uint64, error) {
+	dirp, err := syscall.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var available, total, free uint64
+
+	r1, _, e1 := procGetDiskFreeSpaceExW.Call(
+		uintptr(unsafe.Pointer(dirp)),
+		uintptr(unsafe.Pointer(&available)),
+		uintptr(unsafe.Pointer(&total)),
+		uintptr(unsafe.Pointer(&free)),
+	)
+	if r1 == 0 {
+		return 0, 0, os.NewSyscallError("GetDiskFreeSpaceExW", e1)
+	}
+
+	return total, available, nil
+}
@@ -0,0 +1,301 @@
+package houdini
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"code.cloudfoundry.org/garden"
+)
+
+// garden's CPU limits are cgroup v1 shares, which the kernel converts to v2
+// weights the same way
+const (
+	minCPUShares  = 2
+	maxCPUShares  = 262144
+	defaultWeight = 100
+)
+
+// the period a cgroup's CPU quota is given over
+const cpuPeriod = 100 * time.Millisecond
+
+// the controllers containers' limits are enforced through, enabled for the
+// cgroup root's children where the root has them
+var cgroupControllers = []string{"memory", "cpu", "pids"}
+
+// how long to wait for a cgroup's processes to die before giving up on
+// removing it
+const cgroupDestroyTimeout = 10 * time.Second
+
+// cgroup is a container's cgroup in the cgroup v2 hierarchy, which all of its
+// processes are placed in.
+type cgroup struct {
+	dir string
+}
+
+// enableCgroupControllers has the controllers houdini uses, where available,
+// enabled for the containers' cgroups beneath root.
+func enableCgroupControllers(root string) error {
+	err := os.MkdirAll(root, 0755)
+	if err != nil {
+		return err
+	}
+
+	available, err := os.ReadFile(filepath.Join(root, "cgroup.controllers"))
+	if err != nil {
+		return fmt.Errorf("not a cgroup v2 directory: %s", root)
+	}
+
+	for _, controller := range cgroupControllers {
+		if !containsField(string(available), controller) {
+			continue
+		}
+
+		err := os.WriteFile(filepath.Join(root, "cgroup.subtree_control"), []byte("+"+controller), 0644)
+		if err != nil {
+			return fmt.Errorf("failed to enable %s controller: %s", controller, err)
+		}
+	}
+
+	return nil
+}
+
+func (cgroup *cgroup) create() error {
+	err := os.Mkdir(cgroup.dir, 0755)
+	if err != nil && !os.IsExist(err) {
+		return fmt.Errorf("failed to create cgroup: %s", err)
+	}
+
+	return nil
+}
+
+// supports reports whether the controller is enabled for the cgroup, which
+// may be nil for containers that don't have one.
+func (cgroup *cgroup) supports(controller string) bool {
+	if cgroup == nil {
+		return false
+	}
+
+	enabled, err := os.ReadFile(filepath.Join(cgroup.dir, "cgroup.controllers"))
+	if err != nil {
+		return false
+	}
+
+	return containsField(string(enabled), controller)
+}
+
+// place has the command's process started in the cgroup. The returned file
+// must be kept open until it has started.
+func (cgroup *cgroup) place(cmd *exec.Cmd) (*os.File, error) {
+	dir, err := os.Open(cgroup.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(dir.Fd())
+
+	return dir, nil
+}
+
+func (cgroup *cgroup) setMemoryLimit(limit uint64) error {
+	return cgroup.writeLimit("memory.max", limit)
+}
+
+func (cgroup *cgroup) memoryLimit() (uint64, error) {
+	return cgroup.readLimit("memory.max")
+}
+
+func (cgroup *cgroup) memoryUsage() (uint64, error) {
+	return cgroup.readLimit("memory.current")
+}
+
+func (cgroup *cgroup) setPidLimit(limit uint64) error {
+	return cgroup.writeLimit("pids.max", limit)
+}
+
+func (cgroup *cgroup) pidUsage() (uint64, error) {
+	return cgroup.readLimit("pids.current")
+}
+
+// setCPUWeight sets the cgroup's share of the CPU relative to other cgroups,
+// given in cgroup v1 shares, with 0 meaning the default.
+func (cgroup *cgroup) setCPUWeight(shares uint64) error {
+	weight := uint64(defaultWeight)
+	if shares != 0 {
+		if shares < minCPUShares {
+			shares = minCPUShares
+		} else if shares > maxCPUShares {
+			shares = maxCPUShares
+		}
+
+		weight = 1 + ((shares-minCPUShares)*9999)/(maxCPUShares-minCPUShares)
+	}
+
+	err := os.WriteFile(filepath.Join(cgroup.dir, "cpu.weight"), []byte(strconv.FormatUint(weight, 10)), 0644)
+	if err != nil {
+		return fmt.Errorf("failed to set cpu.weight: %s", err)
+	}
+
+	return nil
+}
+
+// setCPUQuota limits the cgroup to the given number of CPUs' worth of time,
+// with 0 meaning no limit.
+func (cgroup *cgroup) setCPUQuota(cpus float64) error {
+	period := cpuPeriod.Microseconds()
+
+	quota := "max"
+	if cpus != 0 {
+		quota = strconv.FormatInt(int64(cpus*float64(period)), 10)
+	}
+
+	err := os.WriteFile(filepath.Join(cgroup.dir, "cpu.max"), []byte(fmt.Sprintf("%s %d", quota, period)), 0644)
+	if err != nil {
+		return fmt.Errorf("failed to set cpu.max: %s", err)
+	}
+
+	return nil
+}
+
+// cpuUsage reads how much CPU time the cgroup's processes have used, which
+// the kernel keeps track of even without the cpu controller.
+func (cgroup *cgroup) cpuUsage() (garden.ContainerCPUStat, error) {
+	payload, err := os.ReadFile(filepath.Join(cgroup.dir, "cpu.stat"))
+	if err != nil {
+		return garden.ContainerCPUStat{}, err
+	}
+
+	var stat garden.ContainerCPUStat
+	for _, line := range strings.Split(string(payload), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+
+		usec, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+
+		nsec := uint64(time.Duration(usec) * time.Microsecond)
+
+		switch fields[0] {
+		case "usage_usec":
+			stat.Usage = nsec
+		case "user_usec":
+			stat.User = nsec
+		case "system_usec":
+			stat.System = nsec
+		}
+	}
+
+	return stat, nil
+}
+
+// writeLimit writes a limit to one of the cgroup's files, with 0 meaning no
+// limit.
+func (cgroup *cgroup) writeLimit(name string, limit uint64) error {
+	value := "max"
+	if limit != 0 {
+		value = strconv.FormatUint(limit, 10)
+	}
+
+	err := os.WriteFile(filepath.Join(cgroup.dir, name), []byte(value), 0644)
+	if err != nil {
+		return fmt.Errorf("failed to set %s: %s", name, err)
+	}
+
+	return nil
+}
+
+// readLimit reads a limit back from one of the cgroup's files, with no limit
+// read as 0.
+func (cgroup *cgroup) readLimit(name string) (uint64, error) {
+	payload, err := os.ReadFile(filepath.Join(cgroup.dir, name))
+	if err != nil {
+		return 0, err
+	}
+
+	value := strings.TrimSpace(string(payload))
+	if value == "max" {
+		return 0, nil
+	}
+
+	return strconv.ParseUint(value, 10, 64)
+}
+
+// destroy kills anything left in the cgroup and removes it.
+func (cgroup *cgroup) destroy() error {
+	deadline := time.Now().Add(cgroupDestroyTimeout)
+
+	for {
+		err := os.Remove(cgroup.dir)
+		if err == nil || os.IsNotExist(err) {
+			return nil
+		}
+
+		if !errors.Is(err, syscall.EBUSY) {
+			return fmt.Errorf("failed to remove cgroup: %s", err)
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("failed to remove cgroup: processes are still running in %s", cgroup.dir)
+		}
+
+		err = cgroup.kill()
+		if err != nil {
+			return err
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (cgroup *cgroup) kill() error {
+	err := os.WriteFile(filepath.Join(cgroup.dir, "cgroup.kill"), []byte("1"), 0644)
+	if err == nil {
+		return nil
+	}
+
+	// cgroup.kill is fairly new, so fall back to killing them one by one
+	procs, err := os.ReadFile(filepath.Join(cgroup.dir, "cgroup.procs"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	for _, field := range strings.Fields(string(procs)) {
+		pid, err := strconv.Atoi(field)
+		if err != nil {
+			continue
+		}
+
+		_ = syscall.Kill(pid, syscall.SIGKILL)
+	}
+
+	return nil
+}
+
+func containsField(s string, field string) bool {
+	for _, f := range strings.Fields(s) {
+		if f == field {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,69 @@
+// +build !linux
+
+package houdini
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+
+	"code.cloudfoundry.org/garden"
+)
+
+var errCgroupsUnsupported = errors.New("cgroups are only supported on Linux")
+
+type cgroup struct {
+	dir string
+}
+
+func enableCgroupControllers(root string) error {
+	return errCgroupsUnsupported
+}
+
+func (cgroup *cgroup) create() error {
+	return errCgroupsUnsupported
+}
+
+func (cgroup *cgroup) supports(controller string) bool {
+	return false
+}
+
+func (cgroup *cgroup) place(cmd *exec.Cmd) (*os.File, error) {
+	return nil, errCgroupsUnsupported
+}
+
+func (cgroup *cgroup) setMemoryLimit(limit uint64) error {
+	return errCgroupsUnsupported
+}
+
+func (cgroup *cgroup) memoryLimit() (uint64, error) {
+	return 0, errCgroupsUnsupported
+}
+
+func (cgroup *cgroup) memoryUsage() (uint64, error) {
+	return 0, errCgroupsUnsupported
+}
+
+func (cgroup *cgroup) setPidLimit(limit uint64) error {
+	return errCgroupsUnsupported
+}
+
+func (cgroup *cgroup) pidUsage() (uint64, error) {
+	return 0, errCgroupsUnsupported
+}
+
+func (cgroup *cgroup) setCPUWeight(shares uint64) error {
+	return errCgroupsUnsupported
+}
+
+func (cgroup *cgroup) setCPUQuota(cpus float64) error {
+	return errCgroupsUnsupported
+}
+
+func (cgroup *cgroup) cpuUsage() (garden.ContainerCPUStat, error) {
+	return garden.ContainerCPUStat{}, errCgroupsUnsupported
+}
+
+func (cgroup *cgroup) destroy() error {
+	return errCgroupsUnsupported
+}
@@ -0,0 +1,9 @@
+package houdini
+
+import "golang.org/x/sys/unix"
+
+// cloneFile creates dest as a copy-on-write clone of src, where the
+// filesystem supports it, e.g. APFS.
+func cloneFile(src string, dest string) error {
+	return unix.Clonefile(src, dest, unix.CLONE_NOFOLLOW)
+}
@@ -0,0 +1,32 @@
+package houdini
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// cloneFile creates dest as a copy-on-write clone of src (FICLONE), where
+// the filesystem supports it, e.g. btrfs or XFS.
+func cloneFile(src string, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+
+	defer in.Close()
+
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	err = unix.IoctlFileClone(int(out.Fd()), int(in.Fd()))
+	if err != nil {
+		out.Close()
+		os.Remove(dest)
+		return err
+	}
+
+	return out.Close()
+}
@@ -0,0 +1,9 @@
+// +build !linux,!darwin
+
+package houdini
+
+import "errors"
+
+func cloneFile(src string, dest string) error {
+	return errors.New("cloning files is not supported on this platform")
+}
@@ -52,6 +52,42 @@ var containersDir = flag.String(
 	"directory in which to store containers",
 )
 
+var maxContainers = flag.Uint64(
+	"maxContainers",
+	0,
+	"maximum number of containers that may exist at once (0 for no limit)",
+)
+
+var rootfsCacheSize = flag.Uint64(
+	"rootfsCacheSize",
+	houdini.DefaultRootfsCacheSize,
+	"bytes of disk the cache of unpacked tarball and image rootfses may use",
+)
+
+var overlayRawRootfs = flag.Bool(
+	"overlayRawRootfs",
+	false,
+	"give containers with a raw:// rootfs a copy-on-write overlay of it (Linux only)",
+)
+
+var isolate = flag.Bool(
+	"isolate",
+	false,
+	"run each container's processes in new PID, mount, UTS and IPC namespaces (Linux only)",
+)
+
+var cgroupRoot = flag.String(
+	"cgroupRoot",
+	"",
+	"cgroup v2 directory delegated to houdini, in which to give each container a cgroup enforcing its limits (Linux only)",
+)
+
+var shimPath = flag.String(
+	"shim",
+	"",
+	"path to the houdini-shim binary; if set, containers and their processes are kept running across restarts",
+)
+
 func main() {
 	flag.Parse()
 
@@ -63,7 +99,34 @@ func main() {
 		logger.Fatal("failed-to-determine-depot-dir", err)
 	}
 
-	backend := houdini.NewBackend(depot)
+	opts := []houdini.BackendOption{
+		houdini.WithLogger(logger.Session("backend")),
+		houdini.WithMaxContainers(*maxContainers),
+		houdini.WithRootfsCacheSize(*rootfsCacheSize),
+	}
+
+	if *overlayRawRootfs {
+		opts = append(opts, houdini.WithRawRootfsOverlay())
+	}
+
+	if *isolate {
+		opts = append(opts, houdini.WithIsolation())
+	}
+
+	if *cgroupRoot != "" {
+		opts = append(opts, houdini.WithCgroupRoot(*cgroupRoot))
+	}
+
+	if *shimPath != "" {
+		shim, err := filepath.Abs(*shimPath)
+		if err != nil {
+			logger.Fatal("failed-to-determine-shim-path", err)
+		}
+
+		opts = append(opts, houdini.WithShim(shim))
+	}
+
+	backend := houdini.NewBackend(depot, opts...)
 
 	gardenServer := server.New(*listenNetwork, *listenAddr, *containerGraceTime, backend, logger)
 
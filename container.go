@@ -1,11 +1,13 @@
 package houdini
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -24,48 +26,165 @@ func (err UndefinedPropertyError) Error() string {
 	return fmt.Sprintf("property does not exist: %s", err.Key)
 }
 
+// OverlayProperty, when set to "true" in a container's spec, gives a
+// container with a raw:// rootfs an overlay of it instead, so that its changes
+// don't show up in the raw rootfs or any other container using it.
+const OverlayProperty = "houdini.overlay"
+
+// IsolationProperty, when set to "true" in a container's spec, runs the
+// container's processes in PID, mount, UTS and IPC namespaces that the
+// container has to itself (on Linux only).
+const IsolationProperty = "houdini.isolate"
+
+// CPUQuotaProperty, when set in a container's spec, limits the container's
+// processes to that many CPUs' worth of time, e.g. "0.5" or "2" (on Linux with
+// a cgroup root only). Setting or removing the property later changes the
+// quota; LimitCPU only changes the container's weight, and leaves the quota
+// alone.
+const CPUQuotaProperty = "houdini.cpu-quota"
+
+// PidLimitProperty is reported in a container's info when it has a pid limit,
+// as the max number of processes it may have.
+const PidLimitProperty = "houdini.pid-limit"
+
 type container struct {
 	spec garden.ContainerSpec
 
+	id     string
 	handle string
 
+	// dir is the container's directory in the depot, holding its state and,
+	// for containers without a rootfs, its work dir
+	dir string
+
+	createdAt time.Time
+
 	workDir   string
 	hasRootfs bool
 
+	// run processes in namespaces of the container's own
+	isolated bool
+
+	// an isolated container's init, whose namespaces its processes run in
+	init *containerInit
+
+	// the cgroup its processes are placed in, if any
+	cgroup *cgroup
+
+	// the project quota its disk usage is limited by, if any
+	quota *diskQuota
+
+	// where the rootfs comes from, if the container has one
+	rootfsURI      *url.URL
+	rootfsProvider RootFSProvider
+
+	// everything mounted for the container, in the order it was mounted
+	mounts  []string
+	mountsL sync.Mutex
+
 	properties  garden.Properties
 	propertiesL sync.RWMutex
 
 	env []string
 
+	limits  garden.Limits
+	limitsL sync.RWMutex
+
+	// defaults for processes, from the rootfs image
+	defaultDir  string
+	defaultUser string
+
 	processTracker process.ProcessTracker
 
+	// enforces the limits the cgroup can't, if any
+	watchdog *process.Watchdog
+
 	graceTime  time.Duration
 	graceTimeL sync.RWMutex
+
+	events  []string
+	eventsL sync.RWMutex
+
+	mappedPorts  []garden.PortMapping
+	mappedPortsL sync.RWMutex
+
+	lifecycle  lifecycle
+	lifecycleL sync.RWMutex
+
+	// the destroy currently in progress, if any
+	destroying *destroyAttempt
+
+	stateL sync.Mutex
+}
+
+// containerInit is the init of an isolated container, which holds the
+// namespaces the container's processes run in.
+type containerInit struct {
+	Pid int `json:"pid"`
+
+	// the init's PID namespace, which tells it apart from whatever is given its
+	// pid once it's gone
+	Namespace string `json:"namespace"`
+}
+
+type lifecycle string
+
+const (
+	lifecycleCreating   lifecycle = "creating"
+	lifecycleActive     lifecycle = "active"
+	lifecycleStopping   lifecycle = "stopping"
+	lifecycleDestroying lifecycle = "destroying"
+)
+
+type destroyAttempt struct {
+	done chan struct{}
+	err  error
+}
+
+// ContainerNotActiveError is returned when running processes in a container
+// that is being created or destroyed.
+type ContainerNotActiveError struct {
+	Handle    string
+	Lifecycle string
+}
+
+func (err ContainerNotActiveError) Error() string {
+	return fmt.Sprintf("container %s is %s", err.Handle, err.Lifecycle)
+}
+
+// PidLimitReachedError is returned when running a process in a container that
+// already has as many processes as its pid limit allows.
+type PidLimitReachedError struct {
+	Handle string
+	Max    uint64
+}
+
+func (err PidLimitReachedError) Error() string {
+	return fmt.Sprintf("container %s has reached its limit of %d processes", err.Handle, err.Max)
 }
 
 func (backend *Backend) newContainer(spec garden.ContainerSpec, id string) (*container, error) {
+	dir := filepath.Join(backend.containersDir, id)
+
+	rootfsURI, err := parseRootfsURI(spec)
+	if err != nil {
+		return nil, err
+	}
+
 	var workDir string
 	var hasRootfs bool
-	if spec.RootFSPath != "" {
-		rootfsURI, err := url.Parse(spec.RootFSPath)
-		if err != nil {
-			return nil, err
+	var rootfsProvider RootFSProvider
+	if rootfsURI != nil {
+		var found bool
+		rootfsProvider, found = backend.rootfsProviders[rootfsURI.Scheme]
+		if !found {
+			return nil, fmt.Errorf("unsupported rootfs uri (must be %s): %s", backend.rootfsSchemes(), rootfsURI)
 		}
 
-		switch rootfsURI.Scheme {
-		case "raw":
-			workDir = rootfsURI.Path
-			hasRootfs = true
-		default:
-			return nil, fmt.Errorf("unsupported rootfs uri (must be raw://): %s", spec.RootFSPath)
-		}
+		// the provider determines the work dir when the container is created
+		hasRootfs = true
 	} else {
-		workDir = filepath.Join(backend.containersDir, id)
-
-		err := fs.MkdirAll(workDir, 0755)
-		if err != nil {
-			return nil, err
-		}
+		workDir = filepath.Join(dir, "workdir")
 	}
 
 	properties := spec.Properties
@@ -73,30 +192,602 @@ func (backend *Backend) newContainer(spec garden.ContainerSpec, id string) (*con
 		properties = garden.Properties{}
 	}
 
-	return &container{
+	_, err = parseCPUQuota(properties)
+	if err != nil {
+		return nil, err
+	}
+
+	container := &container{
 		spec: spec,
 
+		id:     id,
 		handle: spec.Handle,
 
+		dir: dir,
+
+		createdAt: time.Now(),
+
 		workDir:   workDir,
 		hasRootfs: hasRootfs,
 
+		isolated: backend.isolate || spec.Properties[IsolationProperty] == "true",
+
+		cgroup: backend.containerCgroup(id),
+		quota:  backend.containerQuota(),
+
+		rootfsURI:      rootfsURI,
+		rootfsProvider: rootfsProvider,
+
 		properties: properties,
 
 		env: spec.Env,
 
-		processTracker: process.NewTracker(),
-	}, nil
+		limits: spec.Limits,
+
+		processTracker: backend.newProcessTracker(dir),
+
+		graceTime: spec.GraceTime,
+
+		lifecycle: lifecycleCreating,
+	}
+
+	container.watchdog = container.newWatchdog()
+
+	return container, nil
 }
 
-func (container *container) cleanup() error {
+// create brings the container into existence on disk.
+func (container *container) create() error {
+	err := fs.MkdirAll(container.dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	if container.quota != nil {
+		// even without limits, as a reused project ID may still have an old
+		// container's
+		err := container.quota.set(container.currentLimits().Disk)
+		if err != nil {
+			return err
+		}
+	}
+
 	if !container.hasRootfs {
-		return fs.RemoveAll(container.workDir)
+		err := fs.MkdirAll(container.workDir, 0755)
+		if err != nil {
+			return err
+		}
+
+		if container.quota != nil {
+			err := container.quota.assign(container.workDir)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if container.cgroup != nil {
+		err := container.cgroup.create()
+		if err != nil {
+			return err
+		}
+
+		err = container.applyLimits()
+		if err != nil {
+			return err
+		}
+	}
+
+	if container.rootfsProvider != nil {
+		spec := container.rootfsSpec()
+
+		err := fs.MkdirAll(spec.Dir, 0755)
+		if err != nil {
+			return err
+		}
+
+		// whatever the container writes to its rootfs ends up in here, be it
+		// in an overlay's upper dir or a copy
+		if container.quota != nil {
+			err := container.quota.assign(spec.Dir)
+			if err != nil {
+				return err
+			}
+		}
+
+		rootfs, err := container.rootfsProvider.Create(spec)
+		if err != nil {
+			return fmt.Errorf("failed to create rootfs: %s", err)
+		}
+
+		container.workDir = rootfs.Path
+
+		// the spec's env takes precedence over the rootfs's
+		container.env = append(rootfs.Env, container.env...)
+		container.defaultDir = rootfs.Dir
+		container.defaultUser = rootfs.User
+	}
+
+	err = container.setup()
+	if err != nil {
+		return err
+	}
+
+	for _, netIn := range container.spec.NetIn {
+		_, _, err = container.NetIn(netIn.HostPort, netIn.ContainerPort)
+		if err != nil {
+			return err
+		}
+	}
+
+	container.setLifecycle(lifecycleActive)
+
+	err = container.saveState()
+	if err != nil {
+		return err
+	}
+
+	container.watchdog.Start()
+
+	return nil
+}
+
+// destroy stops the container's processes and removes it from disk.
+func (container *container) destroy() error {
+	container.setLifecycle(lifecycleStopping)
+
+	// don't go killing processes that are already on their way out
+	container.watchdog.Stop()
+
+	err := container.Stop(false)
+	if err != nil {
+		return err
+	}
+
+	container.setLifecycle(lifecycleDestroying)
+
+	// record that the container is going away, in case the server goes away
+	// first
+	err = container.saveState()
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return container.cleanup()
+}
+
+// detach stops keeping an eye on the container and lets go of its processes,
+// leaving them running.
+func (container *container) detach() error {
+	container.watchdog.Stop()
+
+	return container.processTracker.Detach()
+}
+
+// parseRootfsURI returns the URI of the rootfs the spec asks for, which may
+// be given as either the rootfs path or the image, or nil if it doesn't ask
+// for one.
+func parseRootfsURI(spec garden.ContainerSpec) (*url.URL, error) {
+	rootfsPath := spec.RootFSPath
+	if spec.Image.URI != "" {
+		if rootfsPath != "" {
+			return nil, errors.New("cannot specify both a rootfs path and an image")
+		}
+
+		rootfsPath = spec.Image.URI
+	}
+
+	if rootfsPath == "" {
+		return nil, nil
+	}
+
+	return url.Parse(rootfsPath)
+}
+
+func (container *container) rootfsSpec() RootFSSpec {
+	return RootFSSpec{
+		ID:         container.id,
+		URI:        container.rootfsURI,
+		Properties: container.currentProperties(),
+		Dir:        filepath.Join(container.dir, "rootfs"),
+	}
+}
+
+func (backend *Backend) restoreContainer(id string) (*container, error) {
+	dir := filepath.Join(backend.containersDir, id)
+
+	state, err := loadState(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	rootfsURI, err := parseRootfsURI(state.Spec)
+	if err != nil {
+		return nil, err
+	}
+
+	var rootfsProvider RootFSProvider
+	if rootfsURI != nil {
+		// may not be found, if the server is no longer configured with it; the
+		// container can't be destroyed until it is
+		rootfsProvider = backend.rootfsProviders[rootfsURI.Scheme]
+	}
+
+	properties := state.Properties
+	if properties == nil {
+		properties = garden.Properties{}
+	}
+
+	limits := state.Spec.Limits
+	if state.Limits != nil {
+		limits = *state.Limits
+	}
+
+	var containerCgroup *cgroup
+	if state.Cgroup != "" {
+		containerCgroup = &cgroup{dir: state.Cgroup}
+	}
+
+	container := &container{
+		spec: state.Spec,
+
+		id:     id,
+		handle: state.Spec.Handle,
+
+		dir: dir,
+
+		createdAt: state.CreatedAt,
+
+		workDir:   state.WorkDir,
+		hasRootfs: state.HasRootfs,
+
+		isolated: state.Isolated,
+		init:     state.Init,
+
+		cgroup: containerCgroup,
+		quota:  backend.restoredQuota(state.Project),
+
+		rootfsURI:      rootfsURI,
+		rootfsProvider: rootfsProvider,
+
+		mounts: state.Mounts,
+
+		properties: properties,
+
+		env: state.Env,
+
+		limits: limits,
+
+		defaultDir:  state.DefaultDir,
+		defaultUser: state.DefaultUser,
+
+		processTracker: backend.newProcessTracker(dir),
+
+		graceTime: state.GraceTime,
+
+		events: state.Events,
+
+		mappedPorts: state.MappedPorts,
+
+		lifecycle: state.Lifecycle,
+	}
+
+	if container.lifecycle == "" {
+		// saved before lifecycles were recorded
+		container.lifecycle = lifecycleActive
+	}
+
+	container.watchdog = container.newWatchdog()
+
+	processDirs, err := os.ReadDir(filepath.Join(dir, "processes"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	for _, processDir := range processDirs {
+		// processes that exited while the server was down cannot be restored,
+		// and are simply forgotten
+		_ = container.processTracker.Restore(processDir.Name())
+	}
+
+	if container.lifecycle == lifecycleActive {
+		err := container.restoreInit()
+		if err != nil {
+			return nil, err
+		}
+
+		container.watchdog.Start()
+	}
+
+	return container, nil
+}
+
+func (container *container) cleanup() error {
+	// take down everything in an isolated container's namespaces
+	err := container.init.kill()
+	if err != nil {
+		return err
+	}
+
+	if container.cgroup != nil {
+		// take down anything the container's processes left behind
+		err := container.cgroup.destroy()
+		if err != nil {
+			return err
+		}
+	}
+
+	if container.quota != nil {
+		err := container.quota.destroy()
+		if err != nil {
+			return err
+		}
+	}
+
+	err = container.unmountAll()
+	if err != nil {
+		return err
+	}
+
+	if container.rootfsURI != nil {
+		if container.rootfsProvider == nil {
+			return fmt.Errorf("no rootfs provider for %s", container.rootfsURI)
+		}
+
+		err := container.rootfsProvider.Destroy(container.rootfsSpec())
+		if err != nil {
+			return fmt.Errorf("failed to destroy rootfs: %s", err)
+		}
+	}
+
+	// make sure nothing is still mounted in the depot before removing it, so
+	// that the removal can't wander into a host directory
+	err = unmountBeneath(container.dir)
+	if err != nil {
+		return err
+	}
+
+	return fs.RemoveAll(container.dir)
+}
+
+// unmountAll unmounts everything mounted for the container, in reverse order.
+// Anything that fails to unmount is kept track of, so that it can be retried.
+func (container *container) unmountAll() error {
+	container.mountsL.Lock()
+	defer container.mountsL.Unlock()
+
+	for len(container.mounts) > 0 {
+		last := container.mounts[len(container.mounts)-1]
+
+		err := unmount(last)
+		if err != nil {
+			return fmt.Errorf("failed to unmount %s: %s", last, err)
+		}
+
+		container.mounts = container.mounts[:len(container.mounts)-1]
+	}
+
+	return nil
+}
+
+func (container *container) currentMounts() []string {
+	container.mountsL.Lock()
+	defer container.mountsL.Unlock()
+	return append([]string{}, container.mounts...)
+}
+
+// ownsWorkDir reports whether the work dir belongs to the container alone,
+// rather than being a rootfs shared with the host.
+func (container *container) ownsWorkDir() bool {
+	return !container.hasRootfs || strings.HasPrefix(container.workDir, container.dir+string(os.PathSeparator))
+}
+
+// applyLimits applies the limits the container was created with to its
+// cgroup.
+func (container *container) applyLimits() error {
+	limits := container.currentLimits()
+
+	if limits.Memory.LimitInBytes != 0 && container.cgroup.supports("memory") {
+		err := container.cgroup.setMemoryLimit(limits.Memory.LimitInBytes)
+		if err != nil {
+			return err
+		}
+	}
+
+	if limits.Pid.Max != 0 && container.cgroup.supports("pids") {
+		err := container.cgroup.setPidLimit(limits.Pid.Max)
+		if err != nil {
+			return err
+		}
+	}
+
+	if container.cgroup.supports("cpu") {
+		shares := cpuShares(limits.CPU)
+		if shares != 0 {
+			err := container.cgroup.setCPUWeight(shares)
+			if err != nil {
+				return err
+			}
+		}
+
+		quota, err := parseCPUQuota(container.currentProperties())
+		if err != nil {
+			return err
+		}
+
+		if quota != 0 {
+			err := container.cgroup.setCPUQuota(quota)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// limitCPUQuota applies a change to the container's CPUQuotaProperty, with 0
+// meaning no limit. The watchdog enforces whatever the property says when
+// there's no cgroup to, so only the cgroup needs to be told.
+func (container *container) limitCPUQuota(quota float64) error {
+	if !container.cgroup.supports("cpu") {
+		return nil
+	}
+
+	return container.cgroup.setCPUQuota(quota)
+}
+
+// how often the watchdog checks on the container's processes
+const watchdogInterval = time.Second
+
+// how often the watchdog checks on the container's disk usage, which may mean
+// walking everything the container has written
+const diskCheckInterval = 5 * time.Second
+
+func (container *container) newWatchdog() *process.Watchdog {
+	watchdog := process.NewWatchdog(
+		container.processTracker,
+		watchdogInterval,
+		container.watchdogLimits,
+		func(violation process.Violation) {
+			_ = container.recordEvent(string(violation))
+		},
+	)
+
+	watchdog.Check(diskCheckInterval, container.checkDiskLimit)
+
+	return watchdog
+}
+
+// watchdogLimits are the limits the watchdog has to enforce, because the
+// container's cgroup can't.
+func (container *container) watchdogLimits() process.WatchdogLimits {
+	var limits process.WatchdogLimits
+
+	if !container.cgroup.supports("memory") {
+		limits.Memory = container.currentLimits().Memory.LimitInBytes
+	}
+
+	if !container.cgroup.supports("cpu") {
+		// validated when the container was created or the property was set
+		limits.CPU, _ = parseCPUQuota(container.currentProperties())
+	}
+
+	return limits
+}
+
+// checkDiskLimit reports a violation once what the container has written is
+// over its hard disk limits, which happens when there's no quota to stop it,
+// or when its processes are privileged enough to ignore the quota (as root
+// is on ext4).
+func (container *container) checkDiskLimit() process.Violation {
+	limits := container.currentLimits().Disk
+	if limits.ByteHard == 0 && limits.InodeHard == 0 {
+		return ""
+	}
+
+	byteLimit := limits.ByteHard
+
+	var bytes, inodes uint64
+	var err error
+	if container.quota != nil {
+		bytes, inodes, err = container.quota.usage()
+		byteLimit = container.quota.byteLimit(byteLimit)
+	} else {
+		bytes, inodes, err = container.exclusiveDiskUsage()
+	}
+
+	if err != nil {
+		return ""
+	}
+
+	if (limits.ByteHard != 0 && bytes > byteLimit) || (limits.InodeHard != 0 && inodes > limits.InodeHard) {
+		return process.ViolationDisk
+	}
+
+	return ""
+}
+
+// checkPidLimit refuses to run another process in a container that already
+// has as many as its pid limit allows, for when its cgroup can't enforce it.
+// Only the processes the container knows of that are still running and their
+// descendants are counted, not whatever has been given the pid of one that has
+// exited.
+func (container *container) checkPidLimit() error {
+	max := container.currentLimits().Pid.Max
+	if max == 0 || container.cgroup.supports("pids") {
+		return nil
+	}
+
+	usage, err := container.processTracker.Usage()
+	if err == process.ErrUsageUnsupported {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if usage.Processes >= max {
+		return PidLimitReachedError{
+			Handle: container.handle,
+			Max:    max,
+		}
 	}
 
 	return nil
 }
 
+// cpuShares is the container's share of the CPU, which is given as either a
+// weight or, as it used to be, shares.
+func cpuShares(limits garden.CPULimits) uint64 {
+	if limits.Weight != 0 {
+		return limits.Weight
+	}
+
+	return limits.LimitInShares
+}
+
+// parseCPUQuota parses the CPUQuotaProperty, if set, returning 0 otherwise.
+func parseCPUQuota(properties garden.Properties) (float64, error) {
+	value, found := properties[CPUQuotaProperty]
+	if !found {
+		return 0, nil
+	}
+
+	quota, err := strconv.ParseFloat(value, 64)
+	if err != nil || quota <= 0 {
+		return 0, fmt.Errorf("invalid %s (must be a positive number of CPUs): %q", CPUQuotaProperty, value)
+	}
+
+	return quota, nil
+}
+
+// quotaProject is the project ID of the container's disk quota, if it has
+// one.
+func (container *container) quotaProject() uint32 {
+	if container.quota == nil {
+		return 0
+	}
+
+	return container.quota.project
+}
+
+// cgroupDir is where the container's cgroup is, if it has one.
+func (container *container) cgroupDir() string {
+	if container.cgroup == nil {
+		return ""
+	}
+
+	return container.cgroup.dir
+}
+
+// upperDir is where the container's changes to its rootfs go when its rootfs
+// is an overlay.
+func (container *container) upperDir() string {
+	return filepath.Join(container.dir, "rootfs", overlayUpperDir)
+}
+
 func (container *container) Handle() string {
 	return container.handle
 }
@@ -105,7 +796,28 @@ func (container *container) Stop(kill bool) error {
 	return container.processTracker.Stop(kill)
 }
 
-func (container *container) Info() (garden.ContainerInfo, error) { return garden.ContainerInfo{}, nil }
+func (container *container) Info() (garden.ContainerInfo, error) {
+	processIDs := []string{}
+	for _, process := range container.processTracker.ActiveProcesses() {
+		processIDs = append(processIDs, process.ID())
+	}
+
+	properties := container.currentProperties()
+
+	pidLimit := container.currentLimits().Pid.Max
+	if pidLimit != 0 {
+		properties[PidLimitProperty] = strconv.FormatUint(pidLimit, 10)
+	}
+
+	return garden.ContainerInfo{
+		State:         string(container.currentLifecycle()),
+		Events:        container.currentEvents(),
+		ContainerPath: container.workDir,
+		ProcessIDs:    processIDs,
+		Properties:    properties,
+		MappedPorts:   container.currentMappedPorts(),
+	}, nil
+}
 
 func (container *container) StreamIn(spec garden.StreamInSpec) error {
 	finalDestination := filepath.Join(container.workDir, filepath.FromSlash(spec.Path))
@@ -164,26 +876,110 @@ func (container *container) CurrentBandwidthLimits() (garden.BandwidthLimits, er
 	return garden.BandwidthLimits{}, nil
 }
 
-func (container *container) LimitCPU(limits garden.CPULimits) error { return nil }
+func (container *container) LimitCPU(limits garden.CPULimits) error {
+	if container.cgroup.supports("cpu") {
+		err := container.cgroup.setCPUWeight(cpuShares(limits))
+		if err != nil {
+			return err
+		}
+	}
+
+	container.limitsL.Lock()
+	container.limits.CPU = limits
+	container.limitsL.Unlock()
+
+	return container.saveState()
+}
 
 func (container *container) CurrentCPULimits() (garden.CPULimits, error) {
-	return garden.CPULimits{}, nil
+	// weights can't be converted back to exactly the shares they came from
+	return container.currentLimits().CPU, nil
 }
 
-func (container *container) LimitDisk(limits garden.DiskLimits) error { return nil }
+// LimitDisk limits what the container can write. With a project quota, writes
+// fail once the container is at its limit; without one, nothing stops the
+// writes, and instead the watchdog kills all of the container's processes
+// once it finds the container over its hard limits, which may be some seconds
+// after the fact.
+func (container *container) LimitDisk(limits garden.DiskLimits) error {
+	if container.quota != nil {
+		err := container.quota.set(limits)
+		if err != nil {
+			return err
+		}
+	}
+
+	container.limitsL.Lock()
+	container.limits.Disk = limits
+	container.limitsL.Unlock()
+
+	return container.saveState()
+}
 
 func (container *container) CurrentDiskLimits() (garden.DiskLimits, error) {
-	return garden.DiskLimits{}, nil
+	return container.currentLimits().Disk, nil
 }
 
-func (container *container) LimitMemory(limits garden.MemoryLimits) error { return nil }
+func (container *container) LimitMemory(limits garden.MemoryLimits) error {
+	if container.cgroup.supports("memory") {
+		err := container.cgroup.setMemoryLimit(limits.LimitInBytes)
+		if err != nil {
+			return err
+		}
+	}
+
+	container.limitsL.Lock()
+	container.limits.Memory = limits
+	container.limitsL.Unlock()
+
+	return container.saveState()
+}
 
 func (container *container) CurrentMemoryLimits() (garden.MemoryLimits, error) {
-	return garden.MemoryLimits{}, nil
+	if container.cgroup.supports("memory") {
+		limit, err := container.cgroup.memoryLimit()
+		if err != nil {
+			return garden.MemoryLimits{}, err
+		}
+
+		return garden.MemoryLimits{LimitInBytes: limit}, nil
+	}
+
+	return container.currentLimits().Memory, nil
 }
 
 func (container *container) NetIn(hostPort, containerPort uint32) (uint32, uint32, error) {
-	return 0, 0, nil
+	// containers share the host's network, so a port can only be mapped to
+	// itself
+	if hostPort == 0 {
+		hostPort = containerPort
+	}
+
+	if containerPort == 0 {
+		containerPort = hostPort
+	}
+
+	if hostPort == 0 {
+		return 0, 0, errors.New("cannot pick a port to map: containers share the host's network")
+	}
+
+	if hostPort != containerPort {
+		return 0, 0, fmt.Errorf("cannot map host port %d to container port %d: containers share the host's network", hostPort, containerPort)
+	}
+
+	container.mappedPortsL.Lock()
+	container.mappedPorts = append(container.mappedPorts, garden.PortMapping{
+		HostPort:      hostPort,
+		ContainerPort: containerPort,
+	})
+	container.mappedPortsL.Unlock()
+
+	err := container.saveState()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return hostPort, containerPort, nil
 }
 
 func (container *container) NetOut(garden.NetOutRule) error { return nil }
@@ -191,11 +987,42 @@ func (container *container) NetOut(garden.NetOutRule) error { return nil }
 func (container *container) BulkNetOut([]garden.NetOutRule) error { return nil }
 
 func (container *container) Run(spec garden.ProcessSpec, processIO garden.ProcessIO) (garden.Process, error) {
+	lifecycle := container.currentLifecycle()
+	if lifecycle != lifecycleActive {
+		return nil, ContainerNotActiveError{
+			Handle:    container.handle,
+			Lifecycle: string(lifecycle),
+		}
+	}
+
+	err := container.checkPidLimit()
+	if err != nil {
+		return nil, err
+	}
+
+	if spec.Dir == "" {
+		spec.Dir = container.defaultDir
+	}
+
+	if spec.User == "" {
+		spec.User = container.defaultUser
+	}
+
 	cmd, err := container.cmd(spec)
 	if err != nil {
 		return nil, err
 	}
 
+	if container.cgroup != nil {
+		cgroupDir, err := container.cgroup.place(cmd)
+		if err != nil {
+			return nil, err
+		}
+
+		// the process is in the cgroup once it has started
+		defer cgroupDir.Close()
+	}
+
 	return container.processTracker.Run(
 		spec.ID,
 		cmd,
@@ -221,25 +1048,46 @@ func (container *container) Property(name string) (string, error) {
 }
 
 func (container *container) SetProperty(name string, value string) error {
+	if name == CPUQuotaProperty {
+		quota, err := parseCPUQuota(garden.Properties{name: value})
+		if err != nil {
+			return err
+		}
+
+		err = container.limitCPUQuota(quota)
+		if err != nil {
+			return err
+		}
+	}
+
 	container.propertiesL.Lock()
 	container.properties[name] = value
 	container.propertiesL.Unlock()
 
-	return nil
+	return container.saveState()
 }
 
 func (container *container) RemoveProperty(name string) error {
 	container.propertiesL.Lock()
-	defer container.propertiesL.Unlock()
 
 	_, found := container.properties[name]
 	if !found {
+		container.propertiesL.Unlock()
 		return UndefinedPropertyError{name}
 	}
 
 	delete(container.properties, name)
 
-	return nil
+	container.propertiesL.Unlock()
+
+	if name == CPUQuotaProperty {
+		err := container.limitCPUQuota(0)
+		if err != nil {
+			return err
+		}
+	}
+
+	return container.saveState()
 }
 
 func (container *container) Properties() (garden.Properties, error) {
@@ -247,14 +1095,109 @@ func (container *container) Properties() (garden.Properties, error) {
 }
 
 func (container *container) Metrics() (garden.Metrics, error) {
-	return garden.Metrics{}, nil
+	usage, err := container.processTracker.Usage()
+	if err != nil && err != process.ErrUsageUnsupported {
+		return garden.Metrics{}, err
+	}
+
+	var diskStat garden.ContainerDiskStat
+
+	// a raw rootfs may be as big as the host's, so it isn't walked
+	if container.ownsWorkDir() {
+		diskStat.TotalBytesUsed, diskStat.TotalInodesUsed, err = diskUsage(container.workDir, container.mountPaths()...)
+		if err != nil {
+			return garden.Metrics{}, err
+		}
+	}
+
+	diskStat.ExclusiveBytesUsed, diskStat.ExclusiveInodesUsed, err = container.exclusiveDiskUsage()
+	if err != nil {
+		return garden.Metrics{}, err
+	}
+
+	memoryStat := garden.ContainerMemoryStat{
+		Rss:                   usage.Memory,
+		TotalRss:              usage.Memory,
+		TotalUsageTowardLimit: usage.Memory,
+	}
+
+	// the cgroup knows better what counts toward its limit, e.g. the page cache
+	if container.cgroup.supports("memory") {
+		memoryStat.TotalUsageTowardLimit, err = container.cgroup.memoryUsage()
+		if err != nil {
+			return garden.Metrics{}, err
+		}
+	}
+
+	cpuStat := garden.ContainerCPUStat{
+		Usage:  uint64(usage.CPUUser + usage.CPUSystem),
+		User:   uint64(usage.CPUUser),
+		System: uint64(usage.CPUSystem),
+	}
+
+	// the cgroup also counts processes that have exited
+	if container.cgroup != nil {
+		cpuStat, err = container.cgroup.cpuUsage()
+		if err != nil {
+			return garden.Metrics{}, err
+		}
+	}
+
+	pidStat := garden.ContainerPidStat{
+		Current: usage.Processes,
+		Max:     container.currentLimits().Pid.Max,
+	}
+
+	if container.cgroup.supports("pids") {
+		pidStat.Current, err = container.cgroup.pidUsage()
+		if err != nil {
+			return garden.Metrics{}, err
+		}
+	}
+
+	return garden.Metrics{
+		MemoryStat: memoryStat,
+		CPUStat:    cpuStat,
+		DiskStat:   diskStat,
+		PidStat:    pidStat,
+		Age:        time.Since(container.createdAt),
+	}, nil
+}
+
+// exclusiveDiskUsage totals up the space and inodes used by what belongs to
+// the container alone.
+func (container *container) exclusiveDiskUsage() (uint64, uint64, error) {
+	// a raw rootfs is shared with whoever else uses it
+	if !container.ownsWorkDir() {
+		return 0, 0, nil
+	}
+
+	// with an overlay, only what the container wrote is its own
+	_, err := os.Stat(container.upperDir())
+	if err == nil {
+		return diskUsage(container.upperDir())
+	}
+
+	return diskUsage(container.workDir, container.mountPaths()...)
+}
+
+// mountPaths are where things are mounted into the container's work dir,
+// which aren't the container's own.
+func (container *container) mountPaths() []string {
+	paths := container.currentMounts()
+	for _, bm := range container.spec.BindMounts {
+		paths = append(paths, filepath.Join(container.workDir, filepath.FromSlash(bm.DstPath)))
+	}
+
+	return paths
 }
 
 func (container *container) SetGraceTime(t time.Duration) error {
 	container.graceTimeL.Lock()
 	container.graceTime = t
 	container.graceTimeL.Unlock()
-	return nil
+
+	return container.saveState()
 }
 
 func (container *container) currentProperties() garden.Properties {
@@ -271,8 +1214,73 @@ func (container *container) currentProperties() garden.Properties {
 	return properties
 }
 
+func (container *container) currentLimits() garden.Limits {
+	container.limitsL.RLock()
+	defer container.limitsL.RUnlock()
+	return container.limits
+}
+
 func (container *container) currentGraceTime() time.Duration {
 	container.graceTimeL.RLock()
 	defer container.graceTimeL.RUnlock()
 	return container.graceTime
 }
+
+func (container *container) setLifecycle(lifecycle lifecycle) {
+	container.lifecycleL.Lock()
+	container.lifecycle = lifecycle
+	container.lifecycleL.Unlock()
+}
+
+func (container *container) currentLifecycle() lifecycle {
+	container.lifecycleL.RLock()
+	defer container.lifecycleL.RUnlock()
+	return container.lifecycle
+}
+
+// startDestroying begins a destroy attempt, or returns the one already in
+// progress.
+func (container *container) startDestroying() (*destroyAttempt, bool) {
+	container.lifecycleL.Lock()
+	defer container.lifecycleL.Unlock()
+
+	if container.destroying != nil {
+		return container.destroying, true
+	}
+
+	container.destroying = &destroyAttempt{
+		done: make(chan struct{}),
+	}
+
+	return container.destroying, false
+}
+
+func (container *container) finishDestroying(attempt *destroyAttempt) {
+	container.lifecycleL.Lock()
+	container.destroying = nil
+	container.lifecycleL.Unlock()
+
+	close(attempt.done)
+}
+
+// recordEvent records something that happened to the container, to be
+// reported in its info.
+func (container *container) recordEvent(event string) error {
+	container.eventsL.Lock()
+	container.events = append(container.events, event)
+	container.eventsL.Unlock()
+
+	return container.saveState()
+}
+
+func (container *container) currentEvents() []string {
+	container.eventsL.RLock()
+	defer container.eventsL.RUnlock()
+	return append([]string{}, container.events...)
+}
+
+func (container *container) currentMappedPorts() []garden.PortMapping {
+	container.mappedPortsL.RLock()
+	defer container.mappedPortsL.RUnlock()
+	return append([]garden.PortMapping{}, container.mappedPorts...)
+}
@@ -1,66 +1,137 @@
 package houdini
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"code.cloudfoundry.org/garden"
 )
 
 func (container *container) setup() error {
+	mounts := container.mountSpecs()
+
+	for _, mount := range mounts {
+		err := prepareMountTarget(mount)
+		if err != nil {
+			return err
+		}
+	}
+
+	if container.isolated {
+		// the container's init makes the mounts in the container's mount
+		// namespace
+		return container.startInit()
+	}
+
+	err := container.mountAll(mounts)
+	if err != nil {
+		// don't leave anything mounted for a container that never existed
+		unmountErr := container.unmountAll()
+		if unmountErr != nil {
+			return fmt.Errorf("%s (and failed to roll back mounts: %s)", err, unmountErr)
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// mountSpec is a mount the container's processes see.
+type mountSpec struct {
+	Source string  `json:"source"`
+	Dest   string  `json:"dest"`
+	FSType string  `json:"fs_type"`
+	Flags  uintptr `json:"flags"`
+
+	// whether the mount is of a file, rather than a directory
+	File bool `json:"file,omitempty"`
+}
+
+func (container *container) mountSpecs() []mountSpec {
+	mounts := []mountSpec{}
+
 	if container.hasRootfs {
 		for _, dir := range []string{"/proc", "/dev", "/sys"} {
 			dest := filepath.Join(container.workDir, dir)
 
-			err := os.MkdirAll(dest, 0755)
-			if err != nil {
-				return fmt.Errorf("failed to create target for bind mount: %s", err)
+			if dir == "/proc" && container.isolated {
+				// a fresh procfs only shows the processes in the namespace
+				mounts = append(mounts, mountSpec{Source: "proc", Dest: dest, FSType: "proc"})
+				continue
 			}
 
-			err = syscall.Mount(dir, dest, "none", syscall.MS_BIND|syscall.MS_RDONLY, "")
-			if err != nil {
-				return err
-			}
+			mounts = append(mounts, mountSpec{
+				Source: dir,
+				Dest:   dest,
+				Flags:  syscall.MS_BIND | syscall.MS_RDONLY,
+			})
 		}
 
 		for _, file := range []string{"/etc/resolv.conf", "/etc/hosts"} {
-			dest := filepath.Join(container.workDir, file)
-
-			f, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY, 0644)
-			if err != nil {
-				return fmt.Errorf("failed to create target for bind mount: %s", err)
-			}
-
-			err = f.Close()
-			if err != nil {
-				return err
-			}
-
-			err = syscall.Mount(file, dest, "none", syscall.MS_BIND|syscall.MS_RDONLY, "")
-			if err != nil {
-				return err
-			}
+			mounts = append(mounts, mountSpec{
+				Source: file,
+				Dest:   filepath.Join(container.workDir, file),
+				Flags:  syscall.MS_BIND | syscall.MS_RDONLY,
+				File:   true,
+			})
 		}
+	} else if container.isolated {
+		mounts = append(mounts, mountSpec{Source: "proc", Dest: "/proc", FSType: "proc"})
 	}
 
 	for _, bm := range container.spec.BindMounts {
-		dest := filepath.Join(container.workDir, bm.DstPath)
+		flags := uintptr(syscall.MS_BIND)
+		if bm.Mode == garden.BindMountModeRO {
+			flags |= syscall.MS_RDONLY
+		}
+
+		mounts = append(mounts, mountSpec{
+			Source: bm.SrcPath,
+			Dest:   filepath.Join(container.workDir, bm.DstPath),
+			Flags:  flags,
+		})
+	}
 
-		err := os.MkdirAll(dest, 0755)
+	return mounts
+}
+
+func prepareMountTarget(mount mountSpec) error {
+	if !mount.File {
+		err := os.MkdirAll(mount.Dest, 0755)
 		if err != nil {
 			return fmt.Errorf("failed to create target for bind mount: %s", err)
 		}
 
-		flags := uintptr(syscall.MS_BIND)
-		if bm.Mode == garden.BindMountModeRO {
-			flags |= syscall.MS_RDONLY
-		}
+		return nil
+	}
+
+	// e.g. /etc, which a rootfs built from scratch may not have
+	err := os.MkdirAll(filepath.Dir(mount.Dest), 0755)
+	if err != nil {
+		return fmt.Errorf("failed to create target for bind mount: %s", err)
+	}
 
-		err = syscall.Mount(bm.SrcPath, dest, "none", flags, "")
+	f, err := os.OpenFile(mount.Dest, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create target for bind mount: %s", err)
+	}
+
+	return f.Close()
+}
+
+func (container *container) mountAll(mounts []mountSpec) error {
+	for _, mount := range mounts {
+		err := container.mount(mount)
 		if err != nil {
 			return err
 		}
@@ -69,10 +140,39 @@ func (container *container) setup() error {
 	return nil
 }
 
+// mount makes a mount, recording it so that it is unmounted when the
+// container is destroyed.
+func (container *container) mount(mount mountSpec) error {
+	err := doMount(mount)
+	if err != nil {
+		return err
+	}
+
+	container.mountsL.Lock()
+	container.mounts = append(container.mounts, mount.Dest)
+	container.mountsL.Unlock()
+
+	return nil
+}
+
+func doMount(mount mountSpec) error {
+	fsType := mount.FSType
+	if fsType == "" {
+		fsType = "none"
+	}
+
+	err := syscall.Mount(mount.Source, mount.Dest, fsType, mount.Flags, "")
+	if err != nil {
+		return fmt.Errorf("failed to mount %s to %s: %s", mount.Source, mount.Dest, err)
+	}
+
+	return nil
+}
+
 const defaultRootPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
-// const defaultPath = "/usr/local/bin:/usr/bin:/bin"
+const defaultPath = "/usr/local/bin:/usr/bin:/bin"
 
-func (container *container) path() string {
+func (container *container) path(user *processUser) string {
 	var path string
 	for _, env := range container.env {
 		segs := strings.SplitN(env, "=", 2)
@@ -94,9 +194,7 @@ func (container *container) path() string {
 	}
 
 	if path == "" {
-		// assume running as root for now, since Houdini doesn't currently support
-		// running as a user
-		path = defaultRootPath
+		path = user.defaultPath()
 	}
 
 	var scopedPath string
@@ -112,6 +210,17 @@ func (container *container) path() string {
 }
 
 func (container *container) cmd(spec garden.ProcessSpec) (*exec.Cmd, error) {
+	if container.isolated || (container.hasRootfs && namespacesSupported()) {
+		return container.initCmd(spec)
+	}
+
+	// a chroot is the best that can be done without namespaces
+
+	user, err := container.lookupUser(spec.User)
+	if err != nil {
+		return nil, err
+	}
+
 	var cmd *exec.Cmd
 
 	if container.hasRootfs {
@@ -120,7 +229,7 @@ func (container *container) cmd(spec garden.ProcessSpec) (*exec.Cmd, error) {
 		if !strings.Contains(path, "/") {
 			// find executable within container's $PATH
 
-			absPath, err := lookPath(path, container.path())
+			absPath, err := lookPath(path, container.path(user))
 			if err != nil {
 				return nil, garden.ExecutableNotFoundError{
 					Message: err.Error(),
@@ -140,18 +249,38 @@ func (container *container) cmd(spec garden.ProcessSpec) (*exec.Cmd, error) {
 		}
 
 		cmd.SysProcAttr = &syscall.SysProcAttr{
-			Chroot: container.workDir,
+			Chroot:     container.workDir,
+			Credential: user.credential(),
 		}
 	} else {
 		cmd = exec.Command(spec.Path, spec.Args...)
 		cmd.Dir = filepath.Join(container.workDir, spec.Dir)
+
+		if user != nil {
+			cmd.SysProcAttr = &syscall.SysProcAttr{
+				Credential: user.credential(),
+			}
+		}
 	}
 
-	cmd.Env = append(os.Environ(), append(container.env, spec.Env...)...)
+	cmd.Env = container.processEnv(user, spec)
 
 	return cmd, nil
 }
 
+// processEnv is the environment a process runs with: the server's, then what
+// goes with the user it runs as, then the container's, then its own.
+func (container *container) processEnv(user *processUser, spec garden.ProcessSpec) []string {
+	env := append(os.Environ(), user.env()...)
+
+	if container.hasRootfs {
+		// the server's PATH means nothing in the rootfs
+		env = append(env, "PATH="+user.defaultPath())
+	}
+
+	return append(env, append(container.env, spec.Env...)...)
+}
+
 func findExecutable(file string) error {
 	d, err := os.Stat(file)
 	if err != nil {
@@ -186,3 +315,231 @@ func lookPath(file string, path string) (string, error) {
 
 	return "", &exec.Error{Name: file, Err: exec.ErrNotFound}
 }
+
+// initCmd runs the process through houdini's init, in a mount namespace of its
+// own in which the rootfs, if any, is pivoted into. Isolated containers'
+// processes instead join the namespaces of the container's init, which made
+// the container's mounts and pivoted into its rootfs when it started.
+func (container *container) initCmd(spec garden.ProcessSpec) (*exec.Cmd, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := container.lookupUser(spec.User)
+	if err != nil {
+		return nil, err
+	}
+
+	config := initConfig{
+		Credential: user.credential(),
+	}
+
+	path := spec.Path
+
+	if container.hasRootfs {
+		if !strings.Contains(path, "/") {
+			absPath, err := lookPath(path, container.path(user))
+			if err != nil {
+				return nil, garden.ExecutableNotFoundError{
+					Message: err.Error(),
+				}
+			}
+
+			path = strings.TrimPrefix(absPath, container.workDir)
+		}
+
+		if !container.isolated {
+			config.Rootfs = container.workDir
+		}
+
+		config.Dir = spec.Dir
+		if config.Dir == "" {
+			config.Dir = "/"
+		}
+	} else {
+		// anything else is relative to the process's dir, which the init runs it
+		// from
+		if !strings.Contains(path, "/") {
+			path, err = exec.LookPath(path)
+			if err != nil {
+				return nil, garden.ExecutableNotFoundError{
+					Message: err.Error(),
+				}
+			}
+		}
+
+		config.Dir = filepath.Join(container.workDir, spec.Dir)
+	}
+
+	payload, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := &exec.Cmd{
+		Path: self,
+		Args: append([]string{initArg0, string(payload), path}, spec.Args...),
+		Env:  container.processEnv(user, spec),
+		Dir:  "/",
+		SysProcAttr: &syscall.SysProcAttr{
+			Cloneflags: syscall.CLONE_NEWNS,
+		},
+	}
+
+	if container.isolated {
+		if !container.init.alive() {
+			return nil, errors.New("the container's init has exited")
+		}
+
+		cmd.Args = append([]string{joinArg0, strconv.Itoa(container.init.Pid), string(payload), path}, spec.Args...)
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+
+	return cmd, nil
+}
+
+// where an isolated container's init complains, within the container's dir
+const initLogFile = "init.log"
+
+// how long a killed init has to go away
+const initKillTimeout = 10 * time.Second
+
+// startInit starts an isolated container's init, in new PID, mount, UTS and
+// IPC namespaces which it sets up for the container's processes to join.
+func (container *container) startInit() error {
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	config := initConfig{
+		Hostname: container.hostname(),
+		Mounts:   container.mountSpecs(),
+	}
+
+	if container.hasRootfs {
+		config.Rootfs = container.workDir
+	}
+
+	payload, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+
+	logPath := filepath.Join(container.dir, initLogFile)
+
+	log, err := os.Create(logPath)
+	if err != nil {
+		return err
+	}
+
+	defer log.Close()
+
+	cmd := &exec.Cmd{
+		Path:   self,
+		Args:   []string{initArg0, string(payload)},
+		Dir:    "/",
+		Stderr: log,
+		SysProcAttr: &syscall.SysProcAttr{
+			Cloneflags: syscall.CLONE_NEWNS | syscall.CLONE_NEWPID | syscall.CLONE_NEWUTS | syscall.CLONE_NEWIPC,
+
+			// put the init in its own session so that it isn't taken down along
+			// with the server
+			Setsid: true,
+		},
+	}
+
+	ready, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return fmt.Errorf("failed to start init: %s", err)
+	}
+
+	status, err := io.ReadAll(ready)
+	if err != nil || string(status) != initReady {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+
+		message, _ := os.ReadFile(logPath)
+		return fmt.Errorf("init failed to start: %s", strings.TrimSpace(string(message)))
+	}
+
+	// reap the init whenever it exits
+	go cmd.Wait()
+
+	namespace, err := os.Readlink(fmt.Sprintf("/proc/%d/ns/pid", cmd.Process.Pid))
+	if err != nil {
+		_ = cmd.Process.Kill()
+		return err
+	}
+
+	container.init = &containerInit{
+		Pid:       cmd.Process.Pid,
+		Namespace: namespace,
+	}
+
+	// record it right away, so that it's killed even if the server goes away
+	// before the container is created
+	return container.saveState()
+}
+
+// restoreInit starts a new init for an isolated container whose init has gone
+// away, e.g. along with the host.
+func (container *container) restoreInit() error {
+	if !container.isolated || container.init.alive() {
+		return nil
+	}
+
+	return container.startInit()
+}
+
+// alive reports whether the init is still running, and not just some other
+// process that has been given its pid.
+func (init *containerInit) alive() bool {
+	if init == nil {
+		return false
+	}
+
+	namespace, err := os.Readlink(fmt.Sprintf("/proc/%d/ns/pid", init.Pid))
+	return err == nil && namespace == init.Namespace
+}
+
+// kill kills the init, and with it everything in its PID namespace, waiting
+// for it to go away.
+func (init *containerInit) kill() error {
+	if !init.alive() {
+		return nil
+	}
+
+	err := syscall.Kill(init.Pid, syscall.SIGKILL)
+	if err != nil && err != syscall.ESRCH {
+		return fmt.Errorf("failed to kill init: %s", err)
+	}
+
+	deadline := time.Now().Add(initKillTimeout)
+	for init.alive() {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("init %d is still running", init.Pid)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return nil
+}
+
+// the longest hostname the kernel allows
+const maxHostnameLength = 64
+
+func (container *container) hostname() string {
+	if len(container.handle) > maxHostnameLength {
+		return container.id
+	}
+
+	return container.handle
+}
@@ -0,0 +1,1600 @@
+package houdini_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"code.cloudfoundry.org/garden"
+	"github.com/klauspost/compress/zstd"
+	"github.com/vito/houdini"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+	"github.com/onsi/gomega/gexec"
+)
+
+var _ = Describe("Container on Linux", func() {
+	BeforeEach(func() {
+		if os.Getuid() != 0 {
+			Skip("must be run as root")
+		}
+	})
+
+	Describe("bind mounts", func() {
+		var hostDir string
+
+		BeforeEach(func() {
+			var err error
+			hostDir, err = os.MkdirTemp("", "host-dir")
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(os.WriteFile(filepath.Join(hostDir, "some-file"), []byte("hi"), 0644)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(hostDir)).To(Succeed())
+		})
+
+		It("unmounts them before removing the container", func() {
+			container, err := backend.Create(garden.ContainerSpec{
+				BindMounts: []garden.BindMount{
+					{
+						SrcPath: hostDir,
+						DstPath: "/some/mount",
+						Mode:    garden.BindMountModeRW,
+					},
+				},
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			info, err := container.Info()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(filepath.Join(info.ContainerPath, "some", "mount", "some-file")).To(BeARegularFile())
+
+			Expect(backend.Destroy(container.Handle())).To(Succeed())
+
+			Expect(info.ContainerPath).ToNot(BeADirectory())
+			Expect(filepath.Join(hostDir, "some-file")).To(BeARegularFile())
+		})
+
+		It("leaves them out of the container's disk usage", func() {
+			Expect(os.WriteFile(filepath.Join(hostDir, "big-file"), make([]byte, 1024*1024), 0644)).To(Succeed())
+
+			container, err := backend.Create(garden.ContainerSpec{
+				BindMounts: []garden.BindMount{
+					{
+						SrcPath: hostDir,
+						DstPath: "/some/mount",
+						Mode:    garden.BindMountModeRW,
+					},
+				},
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			metrics, err := container.Metrics()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(metrics.DiskStat.TotalBytesUsed).To(BeNumerically("<", 1024*1024))
+			Expect(metrics.DiskStat.ExclusiveBytesUsed).To(BeNumerically("<", 1024*1024))
+
+			Expect(backend.Destroy(container.Handle())).To(Succeed())
+		})
+
+		It("rolls back mounts if setup fails partway through", func() {
+			_, err := backend.Create(garden.ContainerSpec{
+				BindMounts: []garden.BindMount{
+					{
+						SrcPath: hostDir,
+						DstPath: "/some/mount",
+						Mode:    garden.BindMountModeRW,
+					},
+					{
+						SrcPath: "/bogus/source",
+						DstPath: "/some/other/mount",
+						Mode:    garden.BindMountModeRW,
+					},
+				},
+			})
+			Expect(err).To(HaveOccurred())
+
+			entries, err := os.ReadDir(depotDir)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(entries).To(BeEmpty())
+
+			Expect(filepath.Join(hostDir, "some-file")).To(BeARegularFile())
+		})
+	})
+
+	Describe("isolation", func() {
+		var container garden.Container
+		var hostDir string
+
+		BeforeEach(func() {
+			var err error
+			hostDir, err = os.MkdirTemp("", "host-dir")
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(os.WriteFile(filepath.Join(hostDir, "some-file"), []byte("hi"), 0644)).To(Succeed())
+
+			container, err = backend.Create(garden.ContainerSpec{
+				Handle:     "some-isolated-container",
+				Properties: garden.Properties{houdini.IsolationProperty: "true"},
+				BindMounts: []garden.BindMount{
+					{
+						SrcPath: hostDir,
+						DstPath: "/some/mount",
+						Mode:    garden.BindMountModeRO,
+					},
+				},
+			})
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(hostDir)).To(Succeed())
+		})
+
+		run := func(script string) (int, string) {
+			stdout := gbytes.NewBuffer()
+
+			// the output may trail behind the exit status, so mark where it ends
+			process, err := container.Run(garden.ProcessSpec{
+				Path: "sh",
+				Args: []string{"-c", script + "\nstatus=$?; echo end-of-output; exit $status"},
+			}, garden.ProcessIO{
+				Stdout: io.MultiWriter(stdout, GinkgoWriter),
+				Stderr: GinkgoWriter,
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			status, err := process.Wait()
+			Expect(err).ToNot(HaveOccurred())
+
+			Eventually(stdout).Should(gbytes.Say("end-of-output\n"))
+
+			return status, strings.TrimSuffix(string(stdout.Contents()), "end-of-output\n")
+		}
+
+		It("runs the container's processes in a PID namespace of its own", func() {
+			sibling, err := container.Run(garden.ProcessSpec{
+				Path: "sleep",
+				Args: []string{"10"},
+			}, garden.ProcessIO{})
+			Expect(err).ToNot(HaveOccurred())
+
+			other, err := backend.Create(garden.ContainerSpec{
+				Properties: garden.Properties{houdini.IsolationProperty: "true"},
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = other.Run(garden.ProcessSpec{
+				Path: "sleep",
+				Args: []string{"11"},
+			}, garden.ProcessIO{})
+			Expect(err).ToNot(HaveOccurred())
+
+			// give the processes a moment to start
+			time.Sleep(100 * time.Millisecond)
+
+			status, stdout := run(`for p in /proc/[0-9]*; do tr '\0' ' ' < $p/cmdline; echo; done`)
+			Expect(status).To(Equal(0))
+			Expect(stdout).To(ContainSubstring("sleep 10 \n"))
+			Expect(stdout).ToNot(ContainSubstring("sleep 11"))
+
+			// the container's processes are reaped by its init
+			status, stdout = run(`tr '\0' ' ' < /proc/1/cmdline`)
+			Expect(status).To(Equal(0))
+			Expect(stdout).To(HavePrefix("houdini-init "))
+
+			Expect(sibling.Signal(garden.SignalKill)).To(Succeed())
+			Expect(backend.Destroy(other.Handle())).To(Succeed())
+		})
+
+		It("names the UTS namespace after the container", func() {
+			status, stdout := run(`cat /proc/sys/kernel/hostname`)
+			Expect(status).To(Equal(0))
+			Expect(stdout).To(Equal("some-isolated-container\n"))
+		})
+
+		It("makes bind mounts in the container's own mount namespace", func() {
+			info, err := container.Info()
+			Expect(err).ToNot(HaveOccurred())
+
+			status, _ := run(`cat ` + filepath.Join(info.ContainerPath, "some", "mount", "some-file"))
+			Expect(status).To(Equal(0))
+
+			Expect(filepath.Join(info.ContainerPath, "some", "mount", "some-file")).ToNot(BeAnExistingFile())
+		})
+
+		It("shares the mount namespace among the container's processes", func() {
+			info, err := container.Info()
+			Expect(err).ToNot(HaveOccurred())
+
+			mountPoint := filepath.Join(info.ContainerPath, "some-tmpfs")
+
+			status, _ := run(`mkdir ` + mountPoint + ` && mount -t tmpfs tmpfs ` + mountPoint + ` && echo hi > ` + mountPoint + `/some-file`)
+			Expect(status).To(Equal(0))
+
+			status, stdout := run(`cat ` + mountPoint + `/some-file`)
+			Expect(status).To(Equal(0))
+			Expect(stdout).To(Equal("hi\n"))
+
+			Expect(filepath.Join(mountPoint, "some-file")).ToNot(BeAnExistingFile())
+		})
+
+		It("runs relative paths from the process's dir", func() {
+			info, err := container.Info()
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(os.MkdirAll(filepath.Join(info.ContainerPath, "some-dir"), 0755)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(info.ContainerPath, "some-dir", "some-script"), []byte("#!/bin/sh\necho hello\n"), 0755)).To(Succeed())
+
+			stdout := gbytes.NewBuffer()
+
+			process, err := container.Run(garden.ProcessSpec{
+				Path: "./some-script",
+				Dir:  "some-dir",
+			}, garden.ProcessIO{
+				Stdout: stdout,
+				Stderr: GinkgoWriter,
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(process.Wait()).To(Equal(0))
+
+			Eventually(stdout).Should(gbytes.Say("hello\n"))
+		})
+
+		It("fails to run executables that can't be found", func() {
+			_, err := container.Run(garden.ProcessSpec{
+				Path: "bogus-executable",
+			}, garden.ProcessIO{})
+			Expect(err).To(BeAssignableToTypeOf(garden.ExecutableNotFoundError{}))
+		})
+
+		It("forwards signals to the process", func() {
+			process, err := container.Run(garden.ProcessSpec{
+				Path: "sleep",
+				Args: []string{"10"},
+			}, garden.ProcessIO{})
+			Expect(err).ToNot(HaveOccurred())
+
+			// give the init a moment to start it
+			time.Sleep(100 * time.Millisecond)
+
+			Expect(process.Signal(garden.SignalTerminate)).To(Succeed())
+			Expect(process.Wait()).To(Equal(128 + int(syscall.SIGTERM)))
+		})
+
+		It("takes the process down along with whatever runs it", func() {
+			process, err := container.Run(garden.ProcessSpec{
+				Path: "sleep",
+				Args: []string{"12"},
+			}, garden.ProcessIO{})
+			Expect(err).ToNot(HaveOccurred())
+
+			// give it a moment to start
+			time.Sleep(100 * time.Millisecond)
+
+			Expect(process.Signal(garden.SignalKill)).To(Succeed())
+			process.Wait()
+
+			Eventually(func() string {
+				_, stdout := run(`for p in /proc/[0-9]*; do tr '\0' ' ' < $p/cmdline; echo; done`)
+				return stdout
+			}).ShouldNot(ContainSubstring("sleep 12"))
+		})
+
+		It("kills everything left in the container when it's destroyed", func() {
+			status, _ := run(`sleep 13 & true`)
+			Expect(status).To(Equal(0))
+
+			Expect(backend.Destroy(container.Handle())).To(Succeed())
+
+			cmdlines, err := filepath.Glob("/proc/[0-9]*/cmdline")
+			Expect(err).ToNot(HaveOccurred())
+
+			for _, cmdline := range cmdlines {
+				content, _ := os.ReadFile(cmdline)
+				Expect(string(content)).ToNot(Equal("sleep\x0013\x00"))
+			}
+		})
+	})
+
+	Describe("rootfs confinement", func() {
+		var rootfs string
+		var marker string
+
+		BeforeEach(func() {
+			escape, err := gexec.BuildWithEnvironment("github.com/vito/houdini/testdata/escape", []string{"CGO_ENABLED=0"})
+			Expect(err).ToNot(HaveOccurred())
+
+			rootfs, err = os.MkdirTemp("", "rootfs")
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(os.Mkdir(filepath.Join(rootfs, "etc"), 0755)).To(Succeed())
+
+			binary, err := os.ReadFile(escape)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(os.WriteFile(filepath.Join(rootfs, "escape"), binary, 0755)).To(Succeed())
+
+			markerFile, err := os.CreateTemp("", "marker")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(markerFile.Close()).To(Succeed())
+
+			marker = markerFile.Name()
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(rootfs)).To(Succeed())
+			Expect(os.RemoveAll(marker)).To(Succeed())
+		})
+
+		It("keeps processes from breaking out of the rootfs like they could a chroot", func() {
+			container, err := backend.Create(garden.ContainerSpec{RootFSPath: "raw://" + rootfs})
+			Expect(err).ToNot(HaveOccurred())
+
+			stdout := gbytes.NewBuffer()
+
+			process, err := container.Run(garden.ProcessSpec{
+				Path: "/escape",
+				Args: []string{marker},
+			}, garden.ProcessIO{
+				Stdout: stdout,
+				Stderr: GinkgoWriter,
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(process.Wait()).To(Equal(0))
+			Expect(stdout).To(gbytes.Say("confined"))
+
+			Expect(backend.Destroy(container.Handle())).To(Succeed())
+		})
+	})
+
+	Describe("running as a user", func() {
+		var rootfs string
+
+		BeforeEach(func() {
+			whoami, err := gexec.BuildWithEnvironment("github.com/vito/houdini/testdata/whoami", []string{"CGO_ENABLED=0"})
+			Expect(err).ToNot(HaveOccurred())
+
+			rootfs, err = os.MkdirTemp("", "rootfs")
+			Expect(err).ToNot(HaveOccurred())
+
+			// let the users in
+			Expect(os.Chmod(rootfs, 0755)).To(Succeed())
+
+			Expect(os.Mkdir(filepath.Join(rootfs, "etc"), 0755)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(rootfs, "etc", "passwd"), []byte("root:x:0:0:root:/root:/bin/sh\nsomeone:x:1000:1000::/home/someone:/bin/sh\n"), 0644)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(rootfs, "etc", "group"), []byte("root:x:0:\nsomeone:x:1000:\nsome-group:x:1001:root,someone\n"), 0644)).To(Succeed())
+
+			binary, err := os.ReadFile(whoami)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(os.WriteFile(filepath.Join(rootfs, "whoami"), binary, 0755)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(rootfs)).To(Succeed())
+		})
+
+		run := func(container garden.Container, spec garden.ProcessSpec) (int, string) {
+			stdout := gbytes.NewBuffer()
+
+			process, err := container.Run(spec, garden.ProcessIO{
+				Stdout: io.MultiWriter(stdout, GinkgoWriter),
+				Stderr: GinkgoWriter,
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			status, err := process.Wait()
+			Expect(err).ToNot(HaveOccurred())
+
+			// the output may trail behind the exit status
+			Eventually(stdout).Should(gbytes.Say("PATH=.*\n"))
+
+			return status, string(stdout.Contents())
+		}
+
+		It("resolves the user from the rootfs", func() {
+			container, err := backend.Create(garden.ContainerSpec{RootFSPath: "raw://" + rootfs})
+			Expect(err).ToNot(HaveOccurred())
+
+			status, stdout := run(container, garden.ProcessSpec{Path: "/whoami", User: "someone"})
+			Expect(status).To(Equal(0))
+			Expect(stdout).To(Equal("uid=1000 gid=1000 groups=[1001]\nHOME=/home/someone USER=someone PATH=/usr/local/bin:/usr/bin:/bin\n"))
+
+			status, stdout = run(container, garden.ProcessSpec{Path: "/whoami", User: "someone:some-group"})
+			Expect(status).To(Equal(0))
+			Expect(stdout).To(HavePrefix("uid=1000 gid=1001 "))
+
+			status, stdout = run(container, garden.ProcessSpec{Path: "/whoami", User: "2000"})
+			Expect(status).To(Equal(0))
+			Expect(stdout).To(Equal("uid=2000 gid=0 groups=[]\nHOME=/ USER=2000 PATH=/usr/local/bin:/usr/bin:/bin\n"))
+
+			status, stdout = run(container, garden.ProcessSpec{
+				Path: "/whoami",
+				User: "root",
+				Env:  []string{"HOME=/somewhere-else"},
+			})
+			Expect(status).To(Equal(0))
+			Expect(stdout).To(Equal("uid=0 gid=0 groups=[1001]\nHOME=/somewhere-else USER=root PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin\n"))
+
+			Expect(backend.Destroy(container.Handle())).To(Succeed())
+		})
+
+		It("runs processes as the user in an isolated container", func() {
+			container, err := backend.Create(garden.ContainerSpec{
+				RootFSPath: "raw://" + rootfs,
+				Properties: garden.Properties{houdini.IsolationProperty: "true"},
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			status, stdout := run(container, garden.ProcessSpec{Path: "/whoami", User: "someone"})
+			Expect(status).To(Equal(0))
+			Expect(stdout).To(Equal("uid=1000 gid=1000 groups=[1001]\nHOME=/home/someone USER=someone PATH=/usr/local/bin:/usr/bin:/bin\n"))
+
+			Expect(backend.Destroy(container.Handle())).To(Succeed())
+		})
+
+		It("refuses users the rootfs doesn't know", func() {
+			container, err := backend.Create(garden.ContainerSpec{RootFSPath: "raw://" + rootfs})
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = container.Run(garden.ProcessSpec{Path: "/whoami", User: "nobody"}, garden.ProcessIO{})
+			Expect(err).To(MatchError("unknown user: nobody"))
+
+			_, err = container.Run(garden.ProcessSpec{Path: "/whoami", User: "someone:bogus"}, garden.ProcessIO{})
+			Expect(err).To(MatchError("unknown group: bogus"))
+
+			Expect(backend.Destroy(container.Handle())).To(Succeed())
+		})
+
+		It("resolves the user from the host for containers without a rootfs", func() {
+			// let the user into the container's work dir
+			Expect(os.Chmod(depotDir, 0755)).To(Succeed())
+
+			container, err := backend.Create(garden.ContainerSpec{})
+			Expect(err).ToNot(HaveOccurred())
+
+			status, stdout := run(container, garden.ProcessSpec{Path: filepath.Join(rootfs, "whoami"), User: "nobody"})
+			Expect(status).To(Equal(0))
+			Expect(stdout).To(HavePrefix("uid=65534 gid=65534 "))
+			Expect(stdout).To(ContainSubstring("HOME=/nonexistent USER=nobody "))
+
+			Expect(backend.Destroy(container.Handle())).To(Succeed())
+		})
+	})
+
+	Describe("cgroups", func() {
+		var cgroupRoot string
+
+		BeforeEach(func() {
+			mount := cgroup2Mount()
+			if mount == "" {
+				Skip("cgroup v2 is not mounted")
+			}
+
+			var err error
+			cgroupRoot, err = os.MkdirTemp(mount, "houdini-test-")
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(backend.Stop()).To(Succeed())
+
+			backend = houdini.NewBackend(depotDir, houdini.WithCgroupRoot(cgroupRoot))
+			Expect(backend.Start()).To(Succeed())
+		})
+
+		AfterEach(func() {
+			Expect(backend.Stop()).To(Succeed())
+			Expect(os.Remove(cgroupRoot)).To(Succeed())
+		})
+
+		cgroupOf := func(container garden.Container) string {
+			stdout := gbytes.NewBuffer()
+
+			process, err := container.Run(garden.ProcessSpec{
+				Path: "cat",
+				Args: []string{"/proc/self/cgroup"},
+			}, garden.ProcessIO{
+				Stdout: stdout,
+				Stderr: GinkgoWriter,
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(process.Wait()).To(Equal(0))
+
+			Eventually(stdout).Should(gbytes.Say(`0::(\S+)\n`))
+
+			for _, line := range strings.Split(string(stdout.Contents()), "\n") {
+				if strings.HasPrefix(line, "0::") {
+					return strings.TrimPrefix(line, "0::")
+				}
+			}
+
+			return ""
+		}
+
+		itRunsProcessesInTheCgroup := func() {
+			It("runs the container's processes in a cgroup of its own, and removes it when destroyed", func() {
+				container, err := backend.Create(garden.ContainerSpec{})
+				Expect(err).ToNot(HaveOccurred())
+
+				cgroups, err := os.ReadDir(cgroupRoot)
+				Expect(err).ToNot(HaveOccurred())
+
+				var containerCgroup string
+				for _, entry := range cgroups {
+					if entry.IsDir() {
+						Expect(containerCgroup).To(BeEmpty())
+						containerCgroup = entry.Name()
+					}
+				}
+
+				Expect(containerCgroup).ToNot(BeEmpty())
+				Expect(cgroupOf(container)).To(Equal("/" + filepath.Base(cgroupRoot) + "/" + containerCgroup))
+
+				Expect(backend.Destroy(container.Handle())).To(Succeed())
+
+				Expect(filepath.Join(cgroupRoot, containerCgroup)).ToNot(BeADirectory())
+			})
+		}
+
+		itRunsProcessesInTheCgroup()
+
+		Context("with the shim", func() {
+			BeforeEach(func() {
+				Expect(backend.Stop()).To(Succeed())
+
+				backend = houdini.NewBackend(depotDir, houdini.WithCgroupRoot(cgroupRoot), houdini.WithShim(shimPath))
+				Expect(backend.Start()).To(Succeed())
+			})
+
+			itRunsProcessesInTheCgroup()
+		})
+
+		It("kills anything the container's processes left behind when it's destroyed", func() {
+			container, err := backend.Create(garden.ContainerSpec{})
+			Expect(err).ToNot(HaveOccurred())
+
+			stdout := gbytes.NewBuffer()
+
+			process, err := container.Run(garden.ProcessSpec{
+				Path: "sh",
+				Args: []string{"-c", "sleep 100 >/dev/null 2>&1 & echo $!"},
+			}, garden.ProcessIO{
+				Stdout: stdout,
+				Stderr: GinkgoWriter,
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(process.Wait()).To(Equal(0))
+
+			Eventually(stdout).Should(gbytes.Say(`\d+\n`))
+
+			pid := strings.TrimSpace(string(stdout.Contents()))
+			Expect(filepath.Join("/proc", pid, "cmdline")).To(BeAnExistingFile())
+
+			Expect(backend.Destroy(container.Handle())).To(Succeed())
+
+			Eventually(func() string {
+				cmdline, _ := os.ReadFile(filepath.Join("/proc", pid, "cmdline"))
+				return string(cmdline)
+			}).ShouldNot(ContainSubstring("sleep"))
+		})
+
+		It("reports the CPU usage of all of the container's processes, even those that have exited", func() {
+			container, err := backend.Create(garden.ContainerSpec{})
+			Expect(err).ToNot(HaveOccurred())
+
+			process, err := container.Run(garden.ProcessSpec{
+				Path: "sh",
+				Args: []string{"-c", "i=0; while [ $i -lt 100000 ]; do i=$((i+1)); done"},
+			}, garden.ProcessIO{
+				Stdout: GinkgoWriter,
+				Stderr: GinkgoWriter,
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(process.Wait()).To(Equal(0))
+
+			metrics, err := container.Metrics()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(metrics.CPUStat.Usage).To(BeNumerically(">", 0))
+			Expect(metrics.CPUStat.Usage).To(BeNumerically(">=", metrics.CPUStat.User))
+
+			Expect(backend.Destroy(container.Handle())).To(Succeed())
+		})
+
+		Describe("CPU limits", func() {
+			BeforeEach(func() {
+				controllers, err := os.ReadFile(filepath.Join(cgroupRoot, "cgroup.controllers"))
+				Expect(err).ToNot(HaveOccurred())
+
+				if !strings.Contains(string(controllers), "cpu") {
+					Skip("the cpu controller is not available")
+				}
+			})
+
+			It("enforces the container's CPU weight and quota through its cgroup", func() {
+				container, err := backend.Create(garden.ContainerSpec{
+					Limits: garden.Limits{
+						CPU: garden.CPULimits{Weight: 1024},
+					},
+					Properties: garden.Properties{houdini.CPUQuotaProperty: "1.5"},
+				})
+				Expect(err).ToNot(HaveOccurred())
+
+				cgroupDir := filepath.Join(cgroup2Mount(), cgroupOf(container))
+
+				Expect(os.ReadFile(filepath.Join(cgroupDir, "cpu.weight"))).To(Equal([]byte("39\n")))
+				Expect(os.ReadFile(filepath.Join(cgroupDir, "cpu.max"))).To(Equal([]byte("150000 100000\n")))
+
+				// no longer part of garden.Container, but still supported
+				limiter := container.(interface {
+					LimitCPU(garden.CPULimits) error
+				})
+
+				Expect(limiter.LimitCPU(garden.CPULimits{LimitInShares: 262144})).To(Succeed())
+				Expect(os.ReadFile(filepath.Join(cgroupDir, "cpu.weight"))).To(Equal([]byte("10000\n")))
+				Expect(container.CurrentCPULimits()).To(Equal(garden.CPULimits{LimitInShares: 262144}))
+				Expect(os.ReadFile(filepath.Join(cgroupDir, "cpu.max"))).To(Equal([]byte("150000 100000\n")))
+
+				Expect(backend.Destroy(container.Handle())).To(Succeed())
+			})
+
+			It("changes the quota along with the property", func() {
+				container, err := backend.Create(garden.ContainerSpec{})
+				Expect(err).ToNot(HaveOccurred())
+
+				cgroupDir := filepath.Join(cgroup2Mount(), cgroupOf(container))
+
+				Expect(container.SetProperty(houdini.CPUQuotaProperty, "0.5")).To(Succeed())
+				Expect(os.ReadFile(filepath.Join(cgroupDir, "cpu.max"))).To(Equal([]byte("50000 100000\n")))
+
+				Expect(container.SetProperty(houdini.CPUQuotaProperty, "lots")).To(MatchError(ContainSubstring("invalid houdini.cpu-quota")))
+				Expect(os.ReadFile(filepath.Join(cgroupDir, "cpu.max"))).To(Equal([]byte("50000 100000\n")))
+				Expect(container.Property(houdini.CPUQuotaProperty)).To(Equal("0.5"))
+
+				Expect(container.RemoveProperty(houdini.CPUQuotaProperty)).To(Succeed())
+				Expect(os.ReadFile(filepath.Join(cgroupDir, "cpu.max"))).To(Equal([]byte("max 100000\n")))
+
+				Expect(backend.Destroy(container.Handle())).To(Succeed())
+			})
+		})
+
+		Describe("pid limits", func() {
+			BeforeEach(func() {
+				controllers, err := os.ReadFile(filepath.Join(cgroupRoot, "cgroup.controllers"))
+				Expect(err).ToNot(HaveOccurred())
+
+				if !strings.Contains(string(controllers), "pids") {
+					Skip("the pids controller is not available")
+				}
+			})
+
+			It("enforces the container's pid limit through its cgroup", func() {
+				container, err := backend.Create(garden.ContainerSpec{
+					Limits: garden.Limits{
+						Pid: garden.PidLimits{Max: 10},
+					},
+				})
+				Expect(err).ToNot(HaveOccurred())
+
+				limit, err := os.ReadFile(filepath.Join(cgroup2Mount(), cgroupOf(container), "pids.max"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(limit)).To(Equal("10\n"))
+
+				Expect(backend.Destroy(container.Handle())).To(Succeed())
+			})
+		})
+
+		Describe("memory limits", func() {
+			BeforeEach(func() {
+				controllers, err := os.ReadFile(filepath.Join(cgroupRoot, "cgroup.controllers"))
+				Expect(err).ToNot(HaveOccurred())
+
+				if !strings.Contains(string(controllers), "memory") {
+					Skip("the memory controller is not available")
+				}
+			})
+
+			It("enforces the container's memory limit through its cgroup", func() {
+				container, err := backend.Create(garden.ContainerSpec{
+					Limits: garden.Limits{
+						Memory: garden.MemoryLimits{LimitInBytes: 64 * 1024 * 1024},
+					},
+				})
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(container.CurrentMemoryLimits()).To(Equal(garden.MemoryLimits{LimitInBytes: 64 * 1024 * 1024}))
+
+				// no longer part of garden.Container, but still supported
+				limiter := container.(interface {
+					LimitMemory(garden.MemoryLimits) error
+				})
+
+				Expect(limiter.LimitMemory(garden.MemoryLimits{LimitInBytes: 128 * 1024 * 1024})).To(Succeed())
+				Expect(container.CurrentMemoryLimits()).To(Equal(garden.MemoryLimits{LimitInBytes: 128 * 1024 * 1024}))
+
+				limit, err := os.ReadFile(filepath.Join(cgroup2Mount(), cgroupOf(container), "memory.max"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(limit)).To(Equal("134217728\n"))
+
+				Expect(backend.Destroy(container.Handle())).To(Succeed())
+			})
+		})
+	})
+
+	Describe("disk quotas", func() {
+		var fsDir string
+		var mountPoint string
+		var hog string
+
+		BeforeEach(func() {
+			var err error
+			fsDir, err = os.MkdirTemp("", "quota-fs")
+			Expect(err).ToNot(HaveOccurred())
+
+			// let the user in
+			Expect(os.Chmod(fsDir, 0755)).To(Succeed())
+
+			image := filepath.Join(fsDir, "fs.img")
+			Expect(os.WriteFile(image, nil, 0644)).To(Succeed())
+			Expect(os.Truncate(image, 64*1024*1024)).To(Succeed())
+
+			mountPoint = filepath.Join(fsDir, "mnt")
+			Expect(os.Mkdir(mountPoint, 0755)).To(Succeed())
+
+			output, err := exec.Command("mkfs.ext4", "-q", "-O", "quota,project", image).CombinedOutput()
+			if err != nil {
+				Skip("cannot make a filesystem with project quotas: " + string(output))
+			}
+
+			output, err = exec.Command("mount", "-o", "loop,prjquota", image, mountPoint).CombinedOutput()
+			if err != nil {
+				Skip("cannot mount a filesystem with project quotas: " + string(output))
+			}
+
+			built, err := gexec.Build("github.com/vito/houdini/testdata/hog")
+			Expect(err).ToNot(HaveOccurred())
+
+			binary, err := os.ReadFile(built)
+			Expect(err).ToNot(HaveOccurred())
+
+			hog = filepath.Join(fsDir, "hog")
+			Expect(os.WriteFile(hog, binary, 0755)).To(Succeed())
+
+			Expect(backend.Stop()).To(Succeed())
+
+			backend = houdini.NewBackend(filepath.Join(mountPoint, "depot"))
+			Expect(backend.Start()).To(Succeed())
+		})
+
+		AfterEach(func() {
+			Expect(backend.Stop()).To(Succeed())
+
+			// the mount may not have been made
+			_ = syscall.Unmount(mountPoint, 0)
+
+			Expect(os.RemoveAll(fsDir)).To(Succeed())
+		})
+
+		It("stops the container's processes from writing more than its limit", func() {
+			container, err := backend.Create(garden.ContainerSpec{
+				Limits: garden.Limits{
+					Disk: garden.DiskLimits{ByteHard: 1024 * 1024},
+				},
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			info, err := container.Info()
+			Expect(err).ToNot(HaveOccurred())
+
+			// let the user into the container's work dir
+			Expect(os.Chmod(info.ContainerPath, 0777)).To(Succeed())
+
+			stderr := gbytes.NewBuffer()
+
+			process, err := container.Run(garden.ProcessSpec{
+				Path: hog,
+				Args: []string{"disk", "4"},
+				User: "nobody",
+			}, garden.ProcessIO{
+				Stdout: GinkgoWriter,
+				Stderr: io.MultiWriter(stderr, GinkgoWriter),
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(process.Wait()).To(Equal(1))
+
+			Eventually(stderr).Should(gbytes.Say("disk quota exceeded"))
+
+			metrics, err := container.Metrics()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(metrics.DiskStat.ExclusiveBytesUsed).To(BeNumerically("<=", 1024*1024))
+
+			Expect(backend.Destroy(container.Handle())).To(Succeed())
+		})
+
+		It("kills the container's processes when they're privileged enough to ignore it", func() {
+			container, err := backend.Create(garden.ContainerSpec{
+				Limits: garden.Limits{
+					Disk: garden.DiskLimits{ByteHard: 1024 * 1024},
+				},
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			process, err := container.Run(garden.ProcessSpec{
+				Path: hog,
+				Args: []string{"disk", "4"},
+			}, garden.ProcessIO{
+				Stdout: GinkgoWriter,
+				Stderr: GinkgoWriter,
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(process.Wait()).ToNot(Equal(0))
+
+			info, err := container.Info()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(info.Events).To(Equal([]string{"disk limit exceeded"}))
+
+			Expect(backend.Destroy(container.Handle())).To(Succeed())
+		})
+	})
+
+	Describe("rootfs providers", func() {
+		var provider *fakeRootFSProvider
+
+		BeforeEach(func() {
+			snapshot, err := os.MkdirTemp("", "snapshot")
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(os.Mkdir(filepath.Join(snapshot, "etc"), 0755)).To(Succeed())
+
+			provider = &fakeRootFSProvider{path: snapshot}
+
+			Expect(backend.Stop()).To(Succeed())
+
+			backend = houdini.NewBackend(depotDir, houdini.WithRootFSProvider("snapshot", provider))
+			Expect(backend.Start()).To(Succeed())
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(provider.path)).To(Succeed())
+		})
+
+		It("uses the provider registered for the rootfs uri's scheme", func() {
+			container, err := backend.Create(garden.ContainerSpec{
+				RootFSPath: "snapshot:///some-snapshot",
+				Properties: garden.Properties{"a": "b"},
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			info, err := container.Info()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(info.ContainerPath).To(Equal(provider.path))
+
+			Expect(provider.created).To(HaveLen(1))
+			Expect(provider.created[0].URI.Path).To(Equal("/some-snapshot"))
+			Expect(provider.created[0].Properties).To(Equal(garden.Properties{"a": "b"}))
+			Expect(provider.created[0].Dir).To(BeADirectory())
+
+			Expect(backend.Destroy(container.Handle())).To(Succeed())
+
+			Expect(provider.destroyed).To(HaveLen(1))
+			Expect(provider.destroyed[0].ID).To(Equal(provider.created[0].ID))
+			Expect(provider.destroyed[0].Dir).To(Equal(provider.created[0].Dir))
+			Expect(provider.created[0].Dir).ToNot(BeADirectory())
+		})
+
+		It("keeps the built-in providers", func() {
+			_, err := backend.Create(garden.ContainerSpec{RootFSPath: "bogus:///some-rootfs"})
+			Expect(err).To(MatchError(ContainSubstring("oci://, raw://, snapshot://, tar://")))
+		})
+	})
+
+	Describe("raw rootfs overlay", func() {
+		var rawDir string
+
+		BeforeEach(func() {
+			var err error
+			rawDir, err = os.MkdirTemp("", "raw-rootfs")
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(os.Mkdir(filepath.Join(rawDir, "etc"), 0755)).To(Succeed())
+
+			Expect(os.WriteFile(filepath.Join(rawDir, "some-file"), []byte("original"), 0644)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(rawDir)).To(Succeed())
+		})
+
+		It("doesn't count the raw rootfs toward the disk usage of a container without an overlay", func() {
+			container, err := backend.Create(garden.ContainerSpec{RootFSPath: "raw://" + rawDir})
+			Expect(err).ToNot(HaveOccurred())
+
+			metrics, err := container.Metrics()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(metrics.DiskStat).To(Equal(garden.ContainerDiskStat{}))
+
+			Expect(backend.Destroy(container.Handle())).To(Succeed())
+		})
+
+		itKeepsChangesToItself := func(spec func() garden.ContainerSpec) {
+			It("keeps the container's changes out of the raw rootfs", func() {
+				container, err := backend.Create(spec())
+				Expect(err).ToNot(HaveOccurred())
+
+				info, err := container.Info()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(info.ContainerPath).ToNot(Equal(rawDir))
+
+				Expect(os.WriteFile(filepath.Join(info.ContainerPath, "some-file"), []byte("changed"), 0644)).To(Succeed())
+				Expect(os.WriteFile(filepath.Join(info.ContainerPath, "new-file"), []byte("new"), 0644)).To(Succeed())
+
+				content, err := os.ReadFile(filepath.Join(rawDir, "some-file"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(content)).To(Equal("original"))
+				Expect(filepath.Join(rawDir, "new-file")).ToNot(BeAnExistingFile())
+
+				Expect(backend.Destroy(container.Handle())).To(Succeed())
+
+				Expect(info.ContainerPath).ToNot(BeADirectory())
+				Expect(filepath.Join(rawDir, "some-file")).To(BeARegularFile())
+			})
+		}
+
+		Context("when the container asks for it", func() {
+			itKeepsChangesToItself(func() garden.ContainerSpec {
+				return garden.ContainerSpec{
+					RootFSPath: "raw://" + rawDir,
+					Properties: garden.Properties{houdini.OverlayProperty: "true"},
+				}
+			})
+		})
+
+		Context("when the backend is configured to", func() {
+			BeforeEach(func() {
+				Expect(backend.Stop()).To(Succeed())
+
+				backend = houdini.NewBackend(depotDir, houdini.WithRawRootfsOverlay())
+				Expect(backend.Start()).To(Succeed())
+			})
+
+			itKeepsChangesToItself(func() garden.ContainerSpec {
+				return garden.ContainerSpec{RootFSPath: "raw://" + rawDir}
+			})
+		})
+
+		It("uses the raw rootfs directly otherwise", func() {
+			container, err := backend.Create(garden.ContainerSpec{RootFSPath: "raw://" + rawDir})
+			Expect(err).ToNot(HaveOccurred())
+
+			info, err := container.Info()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(info.ContainerPath).To(Equal(rawDir))
+
+			Expect(backend.Destroy(container.Handle())).To(Succeed())
+		})
+
+		It("can be given as the image instead", func() {
+			container, err := backend.Create(garden.ContainerSpec{
+				Image: garden.ImageRef{URI: "raw://" + rawDir},
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			info, err := container.Info()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(info.ContainerPath).To(Equal(rawDir))
+
+			Expect(backend.Destroy(container.Handle())).To(Succeed())
+		})
+	})
+
+	Describe("tarball rootfs", func() {
+		var archiveDir string
+
+		BeforeEach(func() {
+			var err error
+			archiveDir, err = os.MkdirTemp("", "rootfs-archives")
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(archiveDir)).To(Succeed())
+		})
+
+		for _, ext := range []string{".tar", ".tgz", ".tar.zst"} {
+			ext := ext
+
+			It("extracts a private copy of a "+ext+" and removes it on destroy", func() {
+				archive := filepath.Join(archiveDir, "rootfs"+ext)
+				writeRootfsArchive(archive)
+
+				container1, err := backend.Create(garden.ContainerSpec{RootFSPath: "tar://" + archive})
+				Expect(err).ToNot(HaveOccurred())
+
+				container2, err := backend.Create(garden.ContainerSpec{RootFSPath: "file://" + archive})
+				Expect(err).ToNot(HaveOccurred())
+
+				info1, err := container1.Info()
+				Expect(err).ToNot(HaveOccurred())
+
+				info2, err := container2.Info()
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(info1.ContainerPath).ToNot(Equal(info2.ContainerPath))
+
+				content, err := os.ReadFile(filepath.Join(info1.ContainerPath, "etc", "some-file"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(content)).To(Equal("hello"))
+
+				Expect(os.WriteFile(filepath.Join(info1.ContainerPath, "etc", "some-file"), []byte("changed"), 0644)).To(Succeed())
+
+				content, err = os.ReadFile(filepath.Join(info2.ContainerPath, "etc", "some-file"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(content)).To(Equal("hello"))
+
+				cached, err := filepath.Glob(filepath.Join(depotDir, "rootfs-cache", "*", "rootfs", "etc", "some-file"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(cached).To(HaveLen(1))
+
+				content, err = os.ReadFile(cached[0])
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(content)).To(Equal("hello"))
+
+				Expect(backend.Destroy(container1.Handle())).To(Succeed())
+				Expect(backend.Destroy(container2.Handle())).To(Succeed())
+
+				Expect(info1.ContainerPath).ToNot(BeADirectory())
+				Expect(info2.ContainerPath).ToNot(BeADirectory())
+				Expect(archive).To(BeARegularFile())
+			})
+		}
+
+		It("refuses archives it doesn't know how to decompress", func() {
+			archive := filepath.Join(archiveDir, "rootfs.zip")
+			Expect(os.WriteFile(archive, nil, 0644)).To(Succeed())
+
+			_, err := backend.Create(garden.ContainerSpec{RootFSPath: "tar://" + archive})
+			Expect(err).To(HaveOccurred())
+
+			entries, err := os.ReadDir(depotDir)
+			Expect(err).ToNot(HaveOccurred())
+			for _, entry := range entries {
+				Expect(entry.Name()).To(Equal("rootfs-cache"))
+			}
+
+			cached, err := os.ReadDir(filepath.Join(depotDir, "rootfs-cache"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cached).To(BeEmpty())
+		})
+
+		Describe("caching", func() {
+			var archive string
+
+			BeforeEach(func() {
+				archive = filepath.Join(archiveDir, "rootfs.tgz")
+				writeRootfsArchive(archive)
+			})
+
+			cachedRootfses := func() []os.DirEntry {
+				entries, err := os.ReadDir(filepath.Join(depotDir, "rootfs-cache"))
+				Expect(err).ToNot(HaveOccurred())
+				return entries
+			}
+
+			It("unpacks each tarball once, and keeps it around after it's been used", func() {
+				container1, err := backend.Create(garden.ContainerSpec{RootFSPath: "tar://" + archive})
+				Expect(err).ToNot(HaveOccurred())
+
+				container2, err := backend.Create(garden.ContainerSpec{RootFSPath: "tar://" + archive})
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(cachedRootfses()).To(HaveLen(1))
+
+				Expect(backend.Destroy(container1.Handle())).To(Succeed())
+				Expect(backend.Destroy(container2.Handle())).To(Succeed())
+
+				Expect(cachedRootfses()).To(HaveLen(1))
+			})
+
+			It("only hashes a tarball again once it has changed", func() {
+				container, err := backend.Create(garden.ContainerSpec{RootFSPath: "tar://" + archive})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(backend.Destroy(container.Handle())).To(Succeed())
+
+				info, err := os.Stat(archive)
+				Expect(err).ToNot(HaveOccurred())
+
+				// corrupt it without changing its size or modification time
+				Expect(os.WriteFile(archive, make([]byte, info.Size()), 0644)).To(Succeed())
+				Expect(os.Chtimes(archive, info.ModTime(), info.ModTime())).To(Succeed())
+
+				container, err = backend.Create(garden.ContainerSpec{RootFSPath: "tar://" + archive})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(backend.Destroy(container.Handle())).To(Succeed())
+
+				Expect(cachedRootfses()).To(HaveLen(1))
+
+				later := info.ModTime().Add(time.Minute)
+				Expect(os.Chtimes(archive, later, later)).To(Succeed())
+
+				_, err = backend.Create(garden.ContainerSpec{RootFSPath: "tar://" + archive})
+				Expect(err).To(HaveOccurred())
+			})
+
+			It("only keeps rootfses beyond the max size while they're in use", func() {
+				Expect(backend.Stop()).To(Succeed())
+
+				backend = houdini.NewBackend(depotDir, houdini.WithRootfsCacheSize(0))
+				Expect(backend.Start()).To(Succeed())
+
+				container, err := backend.Create(garden.ContainerSpec{RootFSPath: "tar://" + archive})
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(cachedRootfses()).To(HaveLen(1))
+
+				Expect(backend.Destroy(container.Handle())).To(Succeed())
+
+				Expect(cachedRootfses()).To(BeEmpty())
+			})
+
+			It("forgets about containers that went away while the server was down", func() {
+				Expect(backend.Stop()).To(Succeed())
+
+				backend = houdini.NewBackend(depotDir, houdini.WithRootfsCacheSize(0))
+				Expect(backend.Start()).To(Succeed())
+
+				_, err := backend.Create(garden.ContainerSpec{RootFSPath: "tar://" + archive})
+				Expect(err).ToNot(HaveOccurred())
+
+				// simulate the container's state getting lost, e.g. by a crash
+				// during create
+				entries, err := os.ReadDir(depotDir)
+				Expect(err).ToNot(HaveOccurred())
+				for _, entry := range entries {
+					if entry.Name() != "rootfs-cache" {
+						Expect(os.Remove(filepath.Join(depotDir, entry.Name(), "state.json"))).To(Succeed())
+					}
+				}
+
+				restartBackend(houdini.WithRootfsCacheSize(0))
+
+				Expect(cachedRootfses()).To(BeEmpty())
+			})
+		})
+	})
+
+	Describe("OCI image rootfs", func() {
+		var layoutDir string
+
+		BeforeEach(func() {
+			var err error
+			layoutDir, err = os.MkdirTemp("", "oci-layout")
+			Expect(err).ToNot(HaveOccurred())
+
+			writeOCILayout(layoutDir, "some-tag", [][]tarEntry{
+				{
+					{name: "etc/", dir: true},
+					{name: "etc/some-file", content: "hello"},
+					{name: "etc/removed-file", content: "bye"},
+					{name: "opaque/", dir: true},
+					{name: "opaque/hidden-file", content: "bye"},
+					{name: "replaced", content: "a file"},
+				},
+				{
+					{name: "etc/.wh.removed-file"},
+					{name: "etc/added-file", content: "hi"},
+					{name: "opaque/.wh..wh..opq"},
+					{name: "opaque/new-file", content: "hi"},
+					{name: "replaced/", dir: true},
+					{name: "replaced/now-a-dir", content: "hi"},
+				},
+			})
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(layoutDir)).To(Succeed())
+		})
+
+		It("applies the image's layers, honoring whiteouts", func() {
+			container, err := backend.Create(garden.ContainerSpec{RootFSPath: "oci://" + layoutDir + ":some-tag"})
+			Expect(err).ToNot(HaveOccurred())
+
+			info, err := container.Info()
+			Expect(err).ToNot(HaveOccurred())
+
+			rootfs := info.ContainerPath
+			Expect(filepath.Join(rootfs, "etc", "some-file")).To(BeARegularFile())
+			Expect(filepath.Join(rootfs, "etc", "added-file")).To(BeARegularFile())
+			Expect(filepath.Join(rootfs, "etc", "removed-file")).ToNot(BeAnExistingFile())
+			Expect(filepath.Join(rootfs, "etc", ".wh.removed-file")).ToNot(BeAnExistingFile())
+			Expect(filepath.Join(rootfs, "opaque", "hidden-file")).ToNot(BeAnExistingFile())
+			Expect(filepath.Join(rootfs, "opaque", "new-file")).To(BeARegularFile())
+			Expect(filepath.Join(rootfs, "replaced", "now-a-dir")).To(BeARegularFile())
+
+			Expect(backend.Destroy(container.Handle())).To(Succeed())
+			Expect(rootfs).ToNot(BeADirectory())
+		})
+
+		It("runs processes with the image's env, working dir, and user by default", func() {
+			whoami, err := gexec.BuildWithEnvironment("github.com/vito/houdini/testdata/whoami", []string{"CGO_ENABLED=0"})
+			Expect(err).ToNot(HaveOccurred())
+
+			binary, err := os.ReadFile(whoami)
+			Expect(err).ToNot(HaveOccurred())
+
+			writeOCILayout(layoutDir, "with-whoami", [][]tarEntry{
+				{
+					{name: "etc/", dir: true},
+					{name: "etc/passwd", content: "root:x:0:0:root:/root:/bin/sh\nsomeone:x:1000:1000::/home/someone:/bin/sh\n"},
+					{name: "etc/group", content: "root:x:0:\nsomeone:x:1000:\n"},
+					{name: "etc/whoami", content: string(binary), mode: 0755},
+				},
+			})
+
+			container, err := backend.Create(garden.ContainerSpec{RootFSPath: "oci://" + layoutDir + ":with-whoami"})
+			Expect(err).ToNot(HaveOccurred())
+
+			stdout := gbytes.NewBuffer()
+
+			// a relative path is only found from the image's working dir
+			process, err := container.Run(garden.ProcessSpec{
+				Path: "./whoami",
+				Args: []string{"FROM_IMAGE"},
+			}, garden.ProcessIO{
+				Stdout: stdout,
+				Stderr: GinkgoWriter,
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(process.Wait()).To(Equal(0))
+
+			Eventually(stdout).Should(gbytes.Say("uid=1000 gid=1000 .*\nFROM_IMAGE=yes\nHOME=/home/someone USER=someone "))
+
+			Expect(backend.Destroy(container.Handle())).To(Succeed())
+		})
+
+		It("keeps layers that write through a symlink left by another layer within the rootfs", func() {
+			hostDir, err := os.MkdirTemp("", "host-dir")
+			Expect(err).ToNot(HaveOccurred())
+
+			defer os.RemoveAll(hostDir)
+
+			writeOCILayout(layoutDir, "escaping", [][]tarEntry{
+				{
+					{name: "escape", link: hostDir},
+					{name: "climb", link: "../../../.."},
+				},
+				{
+					{name: "escape/some-file", content: "pwned"},
+					{name: "climb/other-file", content: "pwned"},
+				},
+			})
+
+			container, err := backend.Create(garden.ContainerSpec{RootFSPath: "oci://" + layoutDir + ":escaping"})
+			Expect(err).ToNot(HaveOccurred())
+
+			info, err := container.Info()
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(filepath.Join(hostDir, "some-file")).ToNot(BeAnExistingFile())
+			Expect(os.ReadFile(filepath.Join(info.ContainerPath, hostDir, "some-file"))).To(Equal([]byte("pwned")))
+			Expect(os.ReadFile(filepath.Join(info.ContainerPath, "other-file"))).To(Equal([]byte("pwned")))
+
+			Expect(backend.Destroy(container.Handle())).To(Succeed())
+		})
+
+		It("keeps layers that write through a symlink of their own within the rootfs", func() {
+			hostDir, err := os.MkdirTemp("", "host-dir")
+			Expect(err).ToNot(HaveOccurred())
+
+			defer os.RemoveAll(hostDir)
+
+			writeOCILayout(layoutDir, "escaping", [][]tarEntry{
+				{
+					{name: "escape", link: hostDir},
+					{name: "escape/some-file", content: "pwned"},
+				},
+			})
+
+			container, err := backend.Create(garden.ContainerSpec{RootFSPath: "oci://" + layoutDir + ":escaping"})
+			Expect(err).ToNot(HaveOccurred())
+
+			info, err := container.Info()
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(filepath.Join(hostDir, "some-file")).ToNot(BeAnExistingFile())
+			Expect(os.ReadFile(filepath.Join(info.ContainerPath, hostDir, "some-file"))).To(Equal([]byte("pwned")))
+
+			Expect(backend.Destroy(container.Handle())).To(Succeed())
+		})
+
+		It("refuses layers with symlinks that loop", func() {
+			writeOCILayout(layoutDir, "looping", [][]tarEntry{
+				{
+					{name: "loop", link: "loop"},
+					{name: "loop/some-file", content: "hello"},
+				},
+			})
+
+			_, err := backend.Create(garden.ContainerSpec{RootFSPath: "oci://" + layoutDir + ":looping"})
+			Expect(err).To(MatchError(ContainSubstring("too many symlinks")))
+		})
+
+		It("applies layers to merged-usr images through their symlinks", func() {
+			writeOCILayout(layoutDir, "merged-usr", [][]tarEntry{
+				{
+					{name: "usr/", dir: true},
+					{name: "usr/lib/", dir: true},
+					{name: "usr/bin/", dir: true},
+					{name: "lib", link: "usr/lib"},
+					{name: "bin", link: "/usr/bin"},
+					{name: "usr/lib/old-lib", content: "old"},
+				},
+				{
+					{name: "lib/some-lib", content: "some lib"},
+					{name: "bin/some-bin", content: "some bin"},
+					{name: "lib/other-lib", link: "old-lib"},
+					{name: "lib/.wh.old-lib"},
+				},
+			})
+
+			container, err := backend.Create(garden.ContainerSpec{RootFSPath: "oci://" + layoutDir + ":merged-usr"})
+			Expect(err).ToNot(HaveOccurred())
+
+			info, err := container.Info()
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(os.ReadFile(filepath.Join(info.ContainerPath, "usr", "lib", "some-lib"))).To(Equal([]byte("some lib")))
+			Expect(os.ReadFile(filepath.Join(info.ContainerPath, "usr", "bin", "some-bin"))).To(Equal([]byte("some bin")))
+			Expect(os.Readlink(filepath.Join(info.ContainerPath, "usr", "lib", "other-lib"))).To(Equal("old-lib"))
+			Expect(filepath.Join(info.ContainerPath, "usr", "lib", "old-lib")).ToNot(BeAnExistingFile())
+
+			Expect(os.Readlink(filepath.Join(info.ContainerPath, "lib"))).To(Equal("usr/lib"))
+			Expect(os.Readlink(filepath.Join(info.ContainerPath, "bin"))).To(Equal("/usr/bin"))
+
+			Expect(backend.Destroy(container.Handle())).To(Succeed())
+		})
+
+		It("replaces symlinks rather than writing through them", func() {
+			hostFile, err := os.CreateTemp("", "host-file")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(hostFile.Close()).To(Succeed())
+
+			defer os.RemoveAll(hostFile.Name())
+
+			writeOCILayout(layoutDir, "escaping", [][]tarEntry{
+				{
+					{name: "escape", link: hostFile.Name()},
+				},
+				{
+					{name: "escape", content: "pwned"},
+				},
+			})
+
+			container, err := backend.Create(garden.ContainerSpec{RootFSPath: "oci://" + layoutDir + ":escaping"})
+			Expect(err).ToNot(HaveOccurred())
+
+			info, err := container.Info()
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(os.ReadFile(filepath.Join(info.ContainerPath, "escape"))).To(Equal([]byte("pwned")))
+			Expect(os.ReadFile(hostFile.Name())).To(BeEmpty())
+
+			Expect(backend.Destroy(container.Handle())).To(Succeed())
+		})
+
+		It("supports images without an /etc", func() {
+			writeOCILayout(layoutDir, "scratch", [][]tarEntry{
+				{
+					{name: "some-file", content: "hello"},
+				},
+			})
+
+			container, err := backend.Create(garden.ContainerSpec{RootFSPath: "oci://" + layoutDir + ":scratch"})
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(backend.Destroy(container.Handle())).To(Succeed())
+		})
+
+		It("fails if the tag is not in the layout", func() {
+			_, err := backend.Create(garden.ContainerSpec{RootFSPath: "oci://" + layoutDir + ":bogus-tag"})
+			Expect(err).To(HaveOccurred())
+
+			entries, err := os.ReadDir(depotDir)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(entries).To(BeEmpty())
+		})
+	})
+})
+
+func writeRootfsArchive(path string) {
+	file, err := os.Create(path)
+	Expect(err).ToNot(HaveOccurred())
+
+	defer file.Close()
+
+	var w io.WriteCloser
+	switch filepath.Ext(path) {
+	case ".tgz":
+		w = gzip.NewWriter(file)
+	case ".zst":
+		w, err = zstd.NewWriter(file)
+		Expect(err).ToNot(HaveOccurred())
+	default:
+		w = file
+	}
+
+	tw := tar.NewWriter(w)
+
+	Expect(tw.WriteHeader(&tar.Header{
+		Name:     "etc/",
+		Typeflag: tar.TypeDir,
+		Mode:     0755,
+	})).To(Succeed())
+
+	Expect(tw.WriteHeader(&tar.Header{
+		Name:     "etc/some-file",
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Size:     5,
+	})).To(Succeed())
+
+	_, err = tw.Write([]byte("hello"))
+	Expect(err).ToNot(HaveOccurred())
+
+	Expect(tw.Close()).To(Succeed())
+	Expect(w.Close()).To(Succeed())
+}
+
+type tarEntry struct {
+	name    string
+	content string
+	dir     bool
+	link    string
+	mode    int64
+}
+
+// writeOCILayout writes an image layout with a single image, whose layers
+// alternate between uncompressed and gzipped.
+func writeOCILayout(dir string, tag string, layers [][]tarEntry) {
+	writeBlob := func(mediaType string, payload []byte) map[string]interface{} {
+		sum := sha256.Sum256(payload)
+		digest := hex.EncodeToString(sum[:])
+
+		Expect(os.MkdirAll(filepath.Join(dir, "blobs", "sha256"), 0755)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(dir, "blobs", "sha256", digest), payload, 0644)).To(Succeed())
+
+		return map[string]interface{}{
+			"mediaType": mediaType,
+			"digest":    "sha256:" + digest,
+			"size":      len(payload),
+		}
+	}
+
+	writeJSONBlob := func(mediaType string, value interface{}) map[string]interface{} {
+		payload, err := json.Marshal(value)
+		Expect(err).ToNot(HaveOccurred())
+		return writeBlob(mediaType, payload)
+	}
+
+	layerDescs := []map[string]interface{}{}
+	for i, entries := range layers {
+		buf := new(bytes.Buffer)
+
+		var w io.Writer = buf
+		var gz *gzip.Writer
+		if i%2 == 1 {
+			gz = gzip.NewWriter(buf)
+			w = gz
+		}
+
+		tw := tar.NewWriter(w)
+		for _, entry := range entries {
+			if entry.dir {
+				Expect(tw.WriteHeader(&tar.Header{Name: entry.name, Typeflag: tar.TypeDir, Mode: 0755})).To(Succeed())
+				continue
+			}
+
+			if entry.link != "" {
+				Expect(tw.WriteHeader(&tar.Header{Name: entry.name, Typeflag: tar.TypeSymlink, Linkname: entry.link, Mode: 0777})).To(Succeed())
+				continue
+			}
+
+			mode := entry.mode
+			if mode == 0 {
+				mode = 0644
+			}
+
+			Expect(tw.WriteHeader(&tar.Header{
+				Name:     entry.name,
+				Typeflag: tar.TypeReg,
+				Mode:     mode,
+				Size:     int64(len(entry.content)),
+			})).To(Succeed())
+
+			_, err := tw.Write([]byte(entry.content))
+			Expect(err).ToNot(HaveOccurred())
+		}
+		Expect(tw.Close()).To(Succeed())
+
+		mediaType := "application/vnd.oci.image.layer.v1.tar"
+		if gz != nil {
+			Expect(gz.Close()).To(Succeed())
+			mediaType += "+gzip"
+		}
+
+		layerDescs = append(layerDescs, writeBlob(mediaType, buf.Bytes()))
+	}
+
+	config := writeJSONBlob("application/vnd.oci.image.config.v1+json", map[string]interface{}{
+		"config": map[string]interface{}{
+			"Env":        []string{"FROM_IMAGE=yes"},
+			"WorkingDir": "/etc",
+			"User":       "someone",
+		},
+	})
+
+	manifest := writeJSONBlob("application/vnd.oci.image.manifest.v1+json", map[string]interface{}{
+		"schemaVersion": 2,
+		"config":        config,
+		"layers":        layerDescs,
+	})
+
+	manifest["annotations"] = map[string]string{"org.opencontainers.image.ref.name": tag}
+
+	index, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"manifests":     []interface{}{manifest},
+	})
+	Expect(err).ToNot(HaveOccurred())
+
+	Expect(os.WriteFile(filepath.Join(dir, "index.json"), index, 0644)).To(Succeed())
+}
+
+type fakeRootFSProvider struct {
+	path string
+
+	created   []houdini.RootFSSpec
+	destroyed []houdini.RootFSSpec
+}
+
+func (provider *fakeRootFSProvider) Create(spec houdini.RootFSSpec) (houdini.RootFS, error) {
+	provider.created = append(provider.created, spec)
+	return houdini.RootFS{Path: provider.path}, nil
+}
+
+func (provider *fakeRootFSProvider) Destroy(spec houdini.RootFSSpec) error {
+	provider.destroyed = append(provider.destroyed, spec)
+	return nil
+}
+
+// cgroup2Mount finds where the cgroup v2 hierarchy is mounted, if it is.
+func cgroup2Mount() string {
+	mountinfo, err := os.ReadFile("/proc/self/mountinfo")
+	Expect(err).ToNot(HaveOccurred())
+
+	for _, line := range strings.Split(string(mountinfo), "\n") {
+		// the fields after the separator are the fs type and source
+		mountFields, fsFields, found := strings.Cut(line, " - ")
+		if !found || !strings.HasPrefix(fsFields, "cgroup2 ") {
+			continue
+		}
+
+		fields := strings.Fields(mountFields)
+		if len(fields) >= 5 {
+			return fields[4]
+		}
+	}
+
+	return ""
+}
@@ -13,6 +13,10 @@ import (
 )
 
 func (container *container) setup() error {
+	if container.isolated {
+		return errors.New("isolation is only supported on Linux")
+	}
+
 	for _, bm := range container.spec.BindMounts {
 		if bm.Mode == garden.BindMountModeRO {
 			return errors.New("read-only bind mounts are unsupported")
@@ -50,9 +54,22 @@ func (container *container) setup() error {
 }
 
 func (container *container) cmd(spec garden.ProcessSpec) (*exec.Cmd, error) {
+	if spec.User != "" {
+		return nil, errors.New("running processes as another user is only supported on Linux")
+	}
+
 	cmd := exec.Command(filepath.FromSlash(spec.Path), spec.Args...)
 	cmd.Env = append(os.Environ(), append(container.env, spec.Env...)...)
 	cmd.Dir = filepath.Join(container.workDir, filepath.FromSlash(spec.Dir))
 
 	return cmd, nil
 }
+
+// restoreInit does nothing, as only isolated containers have an init.
+func (container *container) restoreInit() error {
+	return nil
+}
+
+func (init *containerInit) kill() error {
+	return nil
+}
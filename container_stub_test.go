@@ -0,0 +1,25 @@
+// +build !linux
+
+package houdini_test
+
+import (
+	"code.cloudfoundry.org/garden"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Container elsewhere", func() {
+	It("refuses to run processes as another user", func() {
+		container, err := backend.Create(garden.ContainerSpec{})
+		Expect(err).ToNot(HaveOccurred())
+
+		_, err = container.Run(garden.ProcessSpec{
+			Path: "true",
+			User: "nobody",
+		}, garden.ProcessIO{})
+		Expect(err).To(MatchError(ContainSubstring("only supported on Linux")))
+
+		Expect(backend.Destroy(container.Handle())).To(Succeed())
+	})
+})
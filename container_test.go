@@ -2,11 +2,14 @@ package houdini_test
 
 import (
 	"io"
+	"time"
 
 	"code.cloudfoundry.org/garden"
+	"github.com/vito/houdini"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gexec"
 )
 
 var _ = Describe("Container", func() {
@@ -23,6 +26,258 @@ var _ = Describe("Container", func() {
 		Expect(err).ToNot(HaveOccurred())
 	})
 
+	Describe("Info", func() {
+		It("reports the container's state, path, properties and processes", func() {
+			Expect(container.SetProperty("a", "b")).To(Succeed())
+
+			hostPort, containerPort, err := container.NetIn(8080, 0)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(hostPort).To(Equal(uint32(8080)))
+			Expect(containerPort).To(Equal(uint32(8080)))
+
+			process, err := container.Run(garden.ProcessSpec{
+				Path: "sleep",
+				Args: []string{"10"},
+			}, garden.ProcessIO{})
+			Expect(err).ToNot(HaveOccurred())
+
+			info, err := container.Info()
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(info.State).To(Equal("active"))
+			Expect(info.ContainerPath).To(BeADirectory())
+			Expect(info.Properties).To(Equal(garden.Properties{"a": "b"}))
+			Expect(info.ProcessIDs).To(ConsistOf(process.ID()))
+			Expect(info.MappedPorts).To(ConsistOf(garden.PortMapping{
+				HostPort:      8080,
+				ContainerPort: 8080,
+			}))
+
+			Expect(process.Signal(garden.SignalKill)).To(Succeed())
+		})
+
+		It("leaves out processes that have exited", func() {
+			process, err := container.Run(garden.ProcessSpec{
+				Path: "true",
+			}, garden.ProcessIO{})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(process.Wait()).To(Equal(0))
+
+			Eventually(func() []string {
+				info, err := container.Info()
+				Expect(err).ToNot(HaveOccurred())
+				return info.ProcessIDs
+			}).Should(BeEmpty())
+		})
+
+		It("refuses an invalid CPU quota", func() {
+			err := container.SetProperty(houdini.CPUQuotaProperty, "lots")
+			Expect(err).To(MatchError(ContainSubstring("invalid houdini.cpu-quota")))
+
+			info, err := container.Info()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(info.Properties).To(BeEmpty())
+		})
+
+		It("refuses to map a port to a different port", func() {
+			_, _, err := container.NetIn(8080, 80)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("Metrics", func() {
+		It("reports the usage of the container's processes and work dir", func() {
+			process, err := container.Run(garden.ProcessSpec{
+				Path: "sh",
+				Args: []string{"-c", "dd if=/dev/zero of=some-file bs=1024 count=1024 && sleep 10"},
+			}, garden.ProcessIO{
+				Stdout: GinkgoWriter,
+				Stderr: GinkgoWriter,
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			Eventually(func() uint64 {
+				metrics, err := container.Metrics()
+				Expect(err).ToNot(HaveOccurred())
+				return metrics.DiskStat.ExclusiveBytesUsed
+			}).Should(BeNumerically(">=", 1024*1024))
+
+			metrics, err := container.Metrics()
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(metrics.PidStat.Current).To(BeNumerically(">=", 1))
+			Expect(metrics.MemoryStat.TotalRss).To(BeNumerically(">", 0))
+			Expect(metrics.Age).To(BeNumerically(">", 0))
+
+			Expect(process.Signal(garden.SignalKill)).To(Succeed())
+		})
+	})
+
+	Describe("Limits", func() {
+		It("keeps track of the CPU limits, across restarts", func() {
+			// no longer part of garden.Container, but still supported
+			limiter := container.(interface {
+				LimitCPU(garden.CPULimits) error
+			})
+
+			Expect(limiter.LimitCPU(garden.CPULimits{Weight: 512})).To(Succeed())
+			Expect(container.CurrentCPULimits()).To(Equal(garden.CPULimits{Weight: 512}))
+
+			restarted := restartBackend()
+
+			restored, err := restarted.Lookup(container.Handle())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(restored.CurrentCPULimits()).To(Equal(garden.CPULimits{Weight: 512}))
+		})
+
+		It("keeps track of the disk limits, across restarts", func() {
+			// no longer part of garden.Container, but still supported
+			limiter := container.(interface {
+				LimitDisk(garden.DiskLimits) error
+			})
+
+			limits := garden.DiskLimits{ByteSoft: 1024 * 1024, ByteHard: 2 * 1024 * 1024, InodeHard: 100}
+
+			Expect(limiter.LimitDisk(limits)).To(Succeed())
+			Expect(container.CurrentDiskLimits()).To(Equal(limits))
+
+			restarted := restartBackend()
+
+			restored, err := restarted.Lookup(container.Handle())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(restored.CurrentDiskLimits()).To(Equal(limits))
+		})
+
+		It("refuses to run more processes than the pid limit allows, and reports it", func() {
+			limited, err := backend.Create(garden.ContainerSpec{
+				Limits: garden.Limits{
+					Pid: garden.PidLimits{Max: 2},
+				},
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			for i := 0; i < 2; i++ {
+				_, err := limited.Run(garden.ProcessSpec{
+					Path: "sleep",
+					Args: []string{"10"},
+				}, garden.ProcessIO{})
+				Expect(err).ToNot(HaveOccurred())
+			}
+
+			_, err = limited.Run(garden.ProcessSpec{
+				Path: "sleep",
+				Args: []string{"10"},
+			}, garden.ProcessIO{})
+			Expect(err).To(Equal(houdini.PidLimitReachedError{Handle: limited.Handle(), Max: 2}))
+
+			info, err := limited.Info()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(info.Properties).To(HaveKeyWithValue(houdini.PidLimitProperty, "2"))
+
+			metrics, err := limited.Metrics()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(metrics.PidStat).To(Equal(garden.ContainerPidStat{Current: 2, Max: 2}))
+
+			Expect(backend.Destroy(limited.Handle())).To(Succeed())
+		})
+
+		It("doesn't count processes that have exited towards the pid limit", func() {
+			limited, err := backend.Create(garden.ContainerSpec{
+				Limits: garden.Limits{
+					Pid: garden.PidLimits{Max: 1},
+				},
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			for i := 0; i < 3; i++ {
+				process, err := limited.Run(garden.ProcessSpec{
+					Path: "true",
+				}, garden.ProcessIO{})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(process.Wait()).To(Equal(0))
+			}
+
+			metrics, err := limited.Metrics()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(metrics.PidStat).To(Equal(garden.ContainerPidStat{Current: 0, Max: 1}))
+
+			Expect(backend.Destroy(limited.Handle())).To(Succeed())
+		})
+	})
+
+	Describe("Watchdog", func() {
+		var hog string
+
+		BeforeEach(func() {
+			var err error
+			hog, err = gexec.Build("github.com/vito/houdini/testdata/hog")
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		itKillsProcessesFor := func(event string, spec garden.ContainerSpec, args ...string) {
+			It("kills the container's processes and records the event", func() {
+				limited, err := backend.Create(spec)
+				Expect(err).ToNot(HaveOccurred())
+
+				process, err := limited.Run(garden.ProcessSpec{
+					Path: hog,
+					Args: args,
+				}, garden.ProcessIO{
+					Stdout: GinkgoWriter,
+					Stderr: GinkgoWriter,
+				})
+				Expect(err).ToNot(HaveOccurred())
+
+				exited := make(chan struct{})
+				go func() {
+					defer GinkgoRecover()
+					process.Wait()
+					close(exited)
+				}()
+
+				Eventually(exited, 10*time.Second).Should(BeClosed())
+
+				info, err := limited.Info()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(info.Events).To(Equal([]string{event}))
+
+				// the events are kept across restarts
+				restarted := restartBackend()
+
+				restored, err := restarted.Lookup(limited.Handle())
+				Expect(err).ToNot(HaveOccurred())
+
+				info, err = restored.Info()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(info.Events).To(Equal([]string{event}))
+
+				Expect(backend.Destroy(limited.Handle())).To(Succeed())
+			})
+		}
+
+		Context("when a container uses more memory than it's limited to", func() {
+			itKillsProcessesFor("out of memory", garden.ContainerSpec{
+				Limits: garden.Limits{
+					Memory: garden.MemoryLimits{LimitInBytes: 32 * 1024 * 1024},
+				},
+			}, "64")
+		})
+
+		Context("when a container uses more CPU time than its quota", func() {
+			itKillsProcessesFor("cpu limit exceeded", garden.ContainerSpec{
+				Properties: garden.Properties{houdini.CPUQuotaProperty: "0.1"},
+			}, "cpu")
+		})
+
+		Context("when a container writes more than its disk limit", func() {
+			itKillsProcessesFor("disk limit exceeded", garden.ContainerSpec{
+				Limits: garden.Limits{
+					Disk: garden.DiskLimits{ByteHard: 1024 * 1024},
+				},
+			}, "disk", "4")
+		})
+	})
+
 	Describe("Streaming", func() {
 		Context("between containers", func() {
 			var destinationContainer garden.Container
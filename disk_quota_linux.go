@@ -0,0 +1,259 @@
+package houdini
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"code.cloudfoundry.org/garden"
+)
+
+// quotactl commands and flags for project quotas, from linux/quota.h
+const (
+	prjQuota = 2
+
+	qGetInfo  = 0x800005
+	qGetQuota = 0x800007
+	qSetQuota = 0x800008
+
+	qifBLimits = 1
+	qifILimits = 4
+
+	// block limits are given in KiB
+	quotaBlockSize = 1024
+)
+
+type ifDqblk struct {
+	BHardLimit uint64
+	BSoftLimit uint64
+	CurSpace   uint64
+	IHardLimit uint64
+	ISoftLimit uint64
+	CurInodes  uint64
+	BTime      uint64
+	ITime      uint64
+	Valid      uint32
+}
+
+type ifDqinfo struct {
+	BGrace uint64
+	IGrace uint64
+	Flags  uint32
+	Valid  uint32
+}
+
+// ioctls for a file's project ID, from linux/fs.h
+const (
+	fsIOCFSGetXAttr = 0x801c581f
+	fsIOCFSSetXAttr = 0x401c5820
+
+	fsXFlagProjInherit = 0x200
+)
+
+type fsxattr struct {
+	XFlags     uint32
+	ExtSize    uint32
+	NExtents   uint32
+	ProjID     uint32
+	CowExtSize uint32
+	Pad        [8]byte
+}
+
+// diskQuota is the project quota that limits the disk usage of a container's
+// work dir, or of its rootfs dir, on filesystems with project quotas enabled,
+// i.e. XFS mounted with prjquota, or ext4 with the project and quota features
+// mounted with prjquota.
+type diskQuota struct {
+	device  string
+	project uint32
+}
+
+// projectQuotaDevice returns the block device of the filesystem that dir is
+// on, if project quotas are enabled for it, or "" if not.
+func projectQuotaDevice(dir string) (string, error) {
+	var stat syscall.Stat_t
+	err := syscall.Stat(dir, &stat)
+	if err != nil {
+		return "", err
+	}
+
+	device, err := mountSource(uint64(stat.Dev))
+	if err != nil {
+		return "", err
+	}
+
+	if device == "" {
+		return "", nil
+	}
+
+	var info ifDqinfo
+	err = quotactl(qGetInfo, device, 0, unsafe.Pointer(&info))
+	if err != nil {
+		// not enabled, or not a block device at all, e.g. tmpfs or overlay
+		return "", nil
+	}
+
+	return device, nil
+}
+
+// mountSource finds what the filesystem with the given device number was
+// mounted from.
+func mountSource(dev uint64) (string, error) {
+	mountinfo, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return "", err
+	}
+
+	defer mountinfo.Close()
+
+	devNum := fmt.Sprintf("%d:%d", major(dev), minor(dev))
+
+	scanner := bufio.NewScanner(mountinfo)
+	for scanner.Scan() {
+		// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[2] != devNum {
+			continue
+		}
+
+		for i, field := range fields {
+			if field == "-" && i+2 < len(fields) {
+				return unescapeMountPath(fields[i+2]), nil
+			}
+		}
+	}
+
+	return "", scanner.Err()
+}
+
+// dirProject returns the project ID of the directory, which is 0 if it has
+// none.
+func dirProject(dir string) (uint32, error) {
+	file, err := os.Open(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	defer file.Close()
+
+	var attr fsxattr
+	err = ioctl(file, fsIOCFSGetXAttr, unsafe.Pointer(&attr))
+	if err != nil {
+		return 0, err
+	}
+
+	return attr.ProjID, nil
+}
+
+// assign has the quota count the directory, which must be empty, and
+// everything created beneath it.
+func (quota *diskQuota) assign(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	var attr fsxattr
+	err = ioctl(file, fsIOCFSGetXAttr, unsafe.Pointer(&attr))
+	if err != nil {
+		return fmt.Errorf("failed to get project of %s: %s", dir, err)
+	}
+
+	attr.ProjID = quota.project
+	attr.XFlags |= fsXFlagProjInherit
+
+	err = ioctl(file, fsIOCFSSetXAttr, unsafe.Pointer(&attr))
+	if err != nil {
+		return fmt.Errorf("failed to set project of %s: %s", dir, err)
+	}
+
+	return nil
+}
+
+// set sets the quota's limits, with 0 meaning no limit.
+func (quota *diskQuota) set(limits garden.DiskLimits) error {
+	dqblk := ifDqblk{
+		BHardLimit: quotaBlocks(limits.ByteHard),
+		BSoftLimit: quotaBlocks(limits.ByteSoft),
+		IHardLimit: limits.InodeHard,
+		ISoftLimit: limits.InodeSoft,
+		Valid:      qifBLimits | qifILimits,
+	}
+
+	err := quotactl(qSetQuota, quota.device, quota.project, unsafe.Pointer(&dqblk))
+	if err != nil {
+		return fmt.Errorf("failed to set disk quota: %s", err)
+	}
+
+	return nil
+}
+
+// usage returns the space and inodes used by everything the quota counts.
+func (quota *diskQuota) usage() (uint64, uint64, error) {
+	var dqblk ifDqblk
+	err := quotactl(qGetQuota, quota.device, quota.project, unsafe.Pointer(&dqblk))
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to get disk quota: %s", err)
+	}
+
+	return dqblk.CurSpace, dqblk.CurInodes, nil
+}
+
+// byteLimit is the limit the quota actually enforces for a limit in bytes.
+func (quota *diskQuota) byteLimit(limit uint64) uint64 {
+	return quotaBlocks(limit) * quotaBlockSize
+}
+
+// destroy lifts the quota's limits, so that the project ID can be reused.
+func (quota *diskQuota) destroy() error {
+	return quota.set(garden.DiskLimits{})
+}
+
+// quotaBlocks converts a limit in bytes to KiB, rounding up.
+func quotaBlocks(bytes uint64) uint64 {
+	return (bytes + quotaBlockSize - 1) / quotaBlockSize
+}
+
+func quotactl(cmd int, device string, id uint32, addr unsafe.Pointer) error {
+	devicePtr, err := syscall.BytePtrFromString(device)
+	if err != nil {
+		return err
+	}
+
+	_, _, errno := syscall.Syscall6(
+		syscall.SYS_QUOTACTL,
+		uintptr(cmd<<8|prjQuota),
+		uintptr(unsafe.Pointer(devicePtr)),
+		uintptr(id),
+		uintptr(addr),
+		0,
+		0,
+	)
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+func ioctl(file *os.File, request uintptr, arg unsafe.Pointer) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, file.Fd(), request, uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+func major(dev uint64) uint64 {
+	return (dev>>8)&0xfff | (dev>>32)&^0xfff
+}
+
+func minor(dev uint64) uint64 {
+	return dev&0xff | (dev>>12)&^0xff
+}
@@ -0,0 +1,44 @@
+// +build !linux
+
+package houdini
+
+import (
+	"errors"
+
+	"code.cloudfoundry.org/garden"
+)
+
+var errQuotasUnsupported = errors.New("disk quotas are only supported on Linux")
+
+type diskQuota struct {
+	device  string
+	project uint32
+}
+
+func projectQuotaDevice(dir string) (string, error) {
+	return "", nil
+}
+
+func dirProject(dir string) (uint32, error) {
+	return 0, errQuotasUnsupported
+}
+
+func (quota *diskQuota) assign(dir string) error {
+	return errQuotasUnsupported
+}
+
+func (quota *diskQuota) set(limits garden.DiskLimits) error {
+	return errQuotasUnsupported
+}
+
+func (quota *diskQuota) usage() (uint64, uint64, error) {
+	return 0, 0, errQuotasUnsupported
+}
+
+func (quota *diskQuota) byteLimit(limit uint64) uint64 {
+	return limit
+}
+
+func (quota *diskQuota) destroy() error {
+	return errQuotasUnsupported
+}
@@ -0,0 +1,73 @@
+package houdini
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// diskUsage totals up the space and inodes used beneath dir, leaving out
+// anything beneath the paths to skip, e.g. bind mounts of directories on the
+// same filesystem. It does not cross into other filesystems either.
+func diskUsage(dir string, skip ...string) (uint64, uint64, error) {
+	root, err := os.Lstat(dir)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	skipped := map[string]bool{}
+	for _, path := range skip {
+		skipped[filepath.Clean(path)] = true
+	}
+
+	rootDev, _ := fileUsage(root)
+
+	var bytes, inodes uint64
+
+	err = filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				// removed while walking
+				return nil
+			}
+
+			return err
+		}
+
+		if path != dir && skipped[path] {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+
+			return err
+		}
+
+		dev, size := fileUsage(info)
+		if dev != rootDev {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		bytes += size
+		inodes++
+
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return bytes, inodes, nil
+}
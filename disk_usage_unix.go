@@ -0,0 +1,19 @@
+// +build !windows
+
+package houdini
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileUsage returns the device a file lives on and the space it takes up on
+// disk.
+func fileUsage(info os.FileInfo) (uint64, uint64) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, uint64(info.Size())
+	}
+
+	return uint64(stat.Dev), uint64(stat.Blocks) * 512
+}
@@ -0,0 +1,10 @@
+package houdini
+
+import "os"
+
+// fileUsage returns the device a file lives on and the space it takes up on
+// disk. Junctions are not followed when walking, so the device doesn't
+// matter.
+func fileUsage(info os.FileInfo) (uint64, uint64) {
+	return 0, uint64(info.Size())
+}
@@ -0,0 +1,5 @@
+package houdini
+
+// CopyRootfs is how containers get a rootfs where overlays can't be mounted,
+// which is hard to bring about in tests on Linux.
+var CopyRootfs = copyRootfs
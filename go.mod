@@ -7,6 +7,7 @@ require (
 	code.cloudfoundry.org/lager v1.1.1-0.20230321195817-3d52f427a2d2
 	github.com/charlievieth/fs v0.0.0-20170613215519-7dc373669fa1
 	github.com/concourse/go-archive v1.0.0
+	github.com/klauspost/compress v1.17.11
 	github.com/nu7hatch/gouuid v0.0.0-20131221200532-179d4d0c4d8d
 	github.com/onsi/ginkgo/v2 v2.12.1
 	github.com/onsi/gomega v1.27.10
@@ -5,6 +5,7 @@ import (
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gexec"
 	"github.com/vito/houdini"
 
 	"testing"
@@ -13,6 +14,18 @@ import (
 var depotDir string
 var backend *houdini.Backend
 
+var shimPath string
+
+var _ = BeforeSuite(func() {
+	var err error
+	shimPath, err = gexec.Build("github.com/vito/houdini/cmd/houdini-shim")
+	Expect(err).ToNot(HaveOccurred())
+})
+
+var _ = AfterSuite(func() {
+	gexec.CleanupBuildArtifacts()
+})
+
 var _ = BeforeEach(func() {
 	var err error
 	depotDir, err = os.MkdirTemp("", "depot")
@@ -24,6 +37,21 @@ var _ = BeforeEach(func() {
 	Expect(err).ToNot(HaveOccurred())
 })
 
+// destroy whatever containers a failed test left behind before anything else
+// is cleaned up, so that nothing is removed through their mounts
+var _ = JustAfterEach(func() {
+	if !CurrentSpecReport().Failed() {
+		return
+	}
+
+	containers, err := backend.Containers(nil)
+	Expect(err).ToNot(HaveOccurred())
+
+	for _, container := range containers {
+		_ = backend.Destroy(container.Handle())
+	}
+})
+
 var _ = AfterEach(func() {
 	backend.Stop()
 
@@ -31,6 +59,17 @@ var _ = AfterEach(func() {
 	Expect(err).ToNot(HaveOccurred())
 })
 
+// restartBackend starts another backend on the depot, as the server would
+// after restarting, and stops it once the test is done.
+func restartBackend(options ...houdini.BackendOption) *houdini.Backend {
+	restarted := houdini.NewBackend(depotDir, options...)
+	Expect(restarted.Start()).To(Succeed())
+
+	DeferCleanup(restarted.Stop)
+
+	return restarted
+}
+
 func TestHoudini(t *testing.T) {
 	RegisterFailHandler(Fail)
 	RunSpecs(t, "Houdini Suite")
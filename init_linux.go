@@ -0,0 +1,495 @@
+package houdini
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"runtime"
+	"strconv"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// initArg0 is what processes run through the init are started as, so that the
+// binary knows to act as their init rather than whatever it normally is. An
+// isolated container's own init is started this way too, without a process.
+const initArg0 = "houdini-init"
+
+// joinArg0 is what processes run in an isolated container are started as, so
+// that the binary knows to join the namespaces of the container's init and run
+// them there.
+const joinArg0 = "houdini-join"
+
+// execArg0 is what processes run in an isolated container are started as once
+// in the container's namespaces, so that the binary knows to run them from
+// there.
+const execArg0 = "houdini-exec"
+
+// the fds a process started by runJoin gets the pipe that tells it whether
+// the joiner is still alive and the container's mount namespace as
+const (
+	aliveFd = 3
+	mntFd   = 4
+)
+
+// initReady is written by an isolated container's init once it has set up the
+// container's namespaces.
+const initReady = "ready"
+
+// initConfig tells the init how to set up the namespaces it's started in.
+type initConfig struct {
+	// only set in a new UTS namespace
+	Hostname string `json:"hostname,omitempty"`
+
+	Mounts []mountSpec `json:"mounts,omitempty"`
+
+	// the rootfs to pivot into, if the container has one, and the directory to
+	// run the process in
+	Rootfs string `json:"rootfs,omitempty"`
+	Dir    string `json:"dir,omitempty"`
+
+	// who to run the process as, if not whoever the init runs as
+	Credential *syscall.Credential `json:"credential,omitempty"`
+}
+
+// namespacesSupported reports whether processes can be run in namespaces of
+// their own.
+func namespacesSupported() bool {
+	if os.Geteuid() != 0 {
+		return false
+	}
+
+	_, err := os.Stat("/proc/self/ns/mnt")
+	return err == nil
+}
+
+func init() {
+	// this has to happen before anything else gets going, so it can't wait for
+	// main to ask for it
+	if len(os.Args) > 0 && os.Args[0] == initArg0 {
+		os.Exit(runInit(os.Args[1:]))
+	}
+
+	if len(os.Args) > 0 && os.Args[0] == joinArg0 {
+		os.Exit(runJoin(os.Args[1:]))
+	}
+
+	if len(os.Args) > 0 && os.Args[0] == execArg0 {
+		os.Exit(runExec(os.Args[1:]))
+	}
+}
+
+// runInit is the entrypoint of the init, which is given its config followed
+// by the process to run. It sets up the namespaces, runs the process,
+// forwards signals to it, and reaps anything left behind, exiting with the
+// process's exit status. Exiting takes down the process along with it, and
+// in a new PID namespace, everything else in it too.
+//
+// Without a process to run, it is an isolated container's init, which sets up
+// the container's namespaces and then keeps them for the container's processes
+// to join, for as long as the container lives.
+func runInit(args []string) int {
+	// the process is killed when the thread that started it exits, so it must
+	// stay put
+	runtime.LockOSThread()
+
+	if len(args) < 1 {
+		fmt.Fprintln(os.Stderr, "usage: houdini-init <config> [<path> [args...]]")
+		return 1
+	}
+
+	var config initConfig
+	err := json.Unmarshal([]byte(args[0]), &config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "houdini-init: invalid config: %s\n", err)
+		return 1
+	}
+
+	// ask for signals before the process exists, so none are missed
+	signals := make(chan os.Signal, 16)
+	signal.Notify(signals)
+
+	err = setupInit(config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "houdini-init: %s\n", err)
+		return 1
+	}
+
+	if len(args) == 1 {
+		return holdNamespaces(signals)
+	}
+
+	return runProcess(processCmd(config, args[1], args[2:]), signals)
+}
+
+// runJoin is the entrypoint for running a process in an isolated container,
+// given the pid of the container's init, the config, and the process to run.
+// It joins the init's namespaces, runs the process, forwards signals to it,
+// and exits with its exit status.
+func runJoin(args []string) int {
+	// the namespaces are only joined by this thread, so the process must be
+	// started from it
+	runtime.LockOSThread()
+
+	if len(args) < 3 {
+		fmt.Fprintln(os.Stderr, "usage: houdini-join <pid> <config> <path> [args...]")
+		return 1
+	}
+
+	pid, err := strconv.Atoi(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "houdini-join: invalid pid: %s\n", err)
+		return 1
+	}
+
+	signals := make(chan os.Signal, 16)
+	signal.Notify(signals)
+
+	mnt, err := joinNamespaces(pid)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "houdini-join: %s\n", err)
+		return 1
+	}
+
+	defer mnt.Close()
+
+	// the write end is held open until this exits, so that the process can
+	// tell if it already has
+	alive, aliveW, err := os.Pipe()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "houdini-join: %s\n", err)
+		return 1
+	}
+
+	defer aliveW.Close()
+
+	// the process is started through the binary once more, from the host's
+	// mount namespace where the binary can be found; see runExec
+	cmd := &exec.Cmd{
+		Path:       "/proc/self/exe",
+		Args:       append([]string{execArg0}, args[1:]...),
+		Env:        os.Environ(),
+		Stdin:      os.Stdin,
+		Stdout:     os.Stdout,
+		Stderr:     os.Stderr,
+		ExtraFiles: []*os.File{alive, mnt},
+	}
+
+	return runProcess(cmd, signals)
+}
+
+// runExec runs a process started by runJoin, given the config and the process
+// to run, with the read end of a pipe held open by the joiner as fd 3 and the
+// container's mount namespace as fd 4. Starting a process in another PID
+// namespace with a parent death signal fails, as it can't see its parent to
+// tell whether it is still alive, so it has to be set here instead. The mount
+// namespace is joined here too, along with the process's directory and user,
+// right before execing the process.
+func runExec(args []string) int {
+	// the mount namespace is only joined by this thread, so the process must be
+	// execed from it
+	runtime.LockOSThread()
+
+	if len(args) < 2 {
+		fmt.Fprintln(os.Stderr, "usage: houdini-exec <config> <path> [args...]")
+		return 1
+	}
+
+	var config initConfig
+	err := json.Unmarshal([]byte(args[0]), &config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "houdini-exec: invalid config: %s\n", err)
+		return 1
+	}
+
+	_, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, syscall.PR_SET_PDEATHSIG, uintptr(syscall.SIGKILL), 0)
+	if errno != 0 {
+		fmt.Fprintf(os.Stderr, "houdini-exec: failed to set parent death signal: %s\n", errno)
+		return 1
+	}
+
+	// the joiner may have died before the parent death signal was set, in which
+	// case the pipe has been closed
+	fds := []unix.PollFd{{Fd: aliveFd, Events: unix.POLLIN}}
+	_, err = unix.Poll(fds, 0)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "houdini-exec: %s\n", err)
+		return 1
+	}
+
+	if fds[0].Revents&unix.POLLHUP != 0 {
+		return 128 + int(syscall.SIGKILL)
+	}
+
+	err = joinMountNamespace(mntFd)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "houdini-exec: %s\n", err)
+		return 1
+	}
+
+	syscall.Close(aliveFd)
+	syscall.Close(mntFd)
+
+	dir := config.Dir
+	if dir == "" {
+		dir = "/"
+	}
+
+	err = syscall.Chdir(dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "houdini-exec: chdir %s: %s\n", dir, err)
+		return 1
+	}
+
+	err = setCredential(config.Credential)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "houdini-exec: %s\n", err)
+		return 1
+	}
+
+	err = syscall.Exec(args[1], args[1:], os.Environ())
+	fmt.Fprintf(os.Stderr, "houdini-exec: %s\n", err)
+	return 127
+}
+
+// runProcess runs the process, forwarding signals to it, and reaps anything
+// left behind until it exits, returning its exit status.
+func runProcess(cmd *exec.Cmd, signals chan os.Signal) int {
+	err := cmd.Start()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", os.Args[0], err)
+		return 127
+	}
+
+	go func() {
+		for sig := range signals {
+			if sig == syscall.SIGCHLD {
+				continue
+			}
+
+			_ = cmd.Process.Signal(sig)
+		}
+	}()
+
+	for {
+		var status syscall.WaitStatus
+		pid, err := syscall.Wait4(-1, &status, 0, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", os.Args[0], err)
+			return 1
+		}
+
+		if pid != cmd.Process.Pid {
+			// an orphan, which is ours to reap
+			continue
+		}
+
+		if status.Signaled() {
+			return 128 + int(status.Signal())
+		}
+
+		return status.ExitStatus()
+	}
+}
+
+// holdNamespaces tells the server that the namespaces are ready, and then
+// reaps whatever is orphaned in them until killed. Signals are otherwise
+// ignored, as the init of a PID namespace can only be killed from outside it.
+func holdNamespaces(signals chan os.Signal) int {
+	_, err := os.Stdout.WriteString(initReady)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "houdini-init: %s\n", err)
+		return 1
+	}
+
+	os.Stdout.Close()
+
+	for {
+		for {
+			var status syscall.WaitStatus
+			pid, err := syscall.Wait4(-1, &status, syscall.WNOHANG, nil)
+			if err == syscall.EINTR {
+				continue
+			}
+
+			if err != nil || pid <= 0 {
+				break
+			}
+		}
+
+		for sig := range signals {
+			if sig == syscall.SIGCHLD {
+				break
+			}
+		}
+	}
+}
+
+// joinNamespaces moves the calling thread into the IPC, UTS and PID
+// namespaces of the process with the given pid, so that processes it starts
+// run in them, and returns its mount namespace for them to join themselves.
+func joinNamespaces(pid int) (*os.File, error) {
+	namespaces := []struct {
+		name string
+		flag int
+	}{
+		{"ipc", syscall.CLONE_NEWIPC},
+		{"uts", syscall.CLONE_NEWUTS},
+		{"pid", syscall.CLONE_NEWPID},
+	}
+
+	for _, ns := range namespaces {
+		file, err := os.Open(fmt.Sprintf("/proc/%d/ns/%s", pid, ns.name))
+		if err != nil {
+			return nil, fmt.Errorf("failed to open %s namespace: %s", ns.name, err)
+		}
+
+		err = unix.Setns(int(file.Fd()), ns.flag)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to join %s namespace: %s", ns.name, err)
+		}
+	}
+
+	mnt, err := os.Open(fmt.Sprintf("/proc/%d/ns/mnt", pid))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open mnt namespace: %s", err)
+	}
+
+	return mnt, nil
+}
+
+// joinMountNamespace moves the calling thread into the mount namespace open as
+// fd, taking on its root.
+func joinMountNamespace(fd int) error {
+	// a thread can only join a mount namespace once it no longer shares its
+	// root and working directory with the process's other threads
+	err := syscall.Unshare(syscall.CLONE_FS)
+	if err != nil {
+		return fmt.Errorf("failed to unshare filesystem attributes: %s", err)
+	}
+
+	err = unix.Setns(fd, syscall.CLONE_NEWNS)
+	if err != nil {
+		return fmt.Errorf("failed to join mnt namespace: %s", err)
+	}
+
+	return nil
+}
+
+// setCredential makes the process run as the given user, if any.
+func setCredential(cred *syscall.Credential) error {
+	if cred == nil {
+		return nil
+	}
+
+	if !cred.NoSetGroups {
+		groups := make([]int, len(cred.Groups))
+		for i, gid := range cred.Groups {
+			groups[i] = int(gid)
+		}
+
+		err := syscall.Setgroups(groups)
+		if err != nil {
+			return fmt.Errorf("failed to set groups: %s", err)
+		}
+	}
+
+	err := syscall.Setgid(int(cred.Gid))
+	if err != nil {
+		return fmt.Errorf("failed to set gid: %s", err)
+	}
+
+	err = syscall.Setuid(int(cred.Uid))
+	if err != nil {
+		return fmt.Errorf("failed to set uid: %s", err)
+	}
+
+	return nil
+}
+
+// setupInit sets up the namespaces the init was started in.
+func setupInit(config initConfig) error {
+	// keep the mounts from propagating back to the host
+	err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, "")
+	if err != nil {
+		return fmt.Errorf("failed to make mounts private: %s", err)
+	}
+
+	for _, mount := range config.Mounts {
+		err := doMount(mount)
+		if err != nil {
+			return err
+		}
+	}
+
+	if config.Hostname != "" {
+		err := syscall.Sethostname([]byte(config.Hostname))
+		if err != nil {
+			return fmt.Errorf("failed to set hostname: %s", err)
+		}
+	}
+
+	if config.Rootfs != "" {
+		err := pivotRoot(config.Rootfs)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// processCmd is the command for the process the init runs, in the directory
+// and as the user the config says.
+func processCmd(config initConfig, path string, args []string) *exec.Cmd {
+	return &exec.Cmd{
+		Path:   path,
+		Args:   append([]string{path}, args...),
+		Env:    os.Environ(),
+		Dir:    config.Dir,
+		Stdin:  os.Stdin,
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+		SysProcAttr: &syscall.SysProcAttr{
+			Credential: config.Credential,
+			Pdeathsig:  syscall.SIGKILL,
+		},
+	}
+}
+
+// pivotRoot makes rootfs the root of the mount namespace, and detaches the
+// old root entirely, so that unlike with a chroot there's no way back to it.
+func pivotRoot(rootfs string) error {
+	// the new root has to be a mount point
+	err := syscall.Mount(rootfs, rootfs, "", syscall.MS_BIND|syscall.MS_REC, "")
+	if err != nil {
+		return fmt.Errorf("failed to bind mount rootfs: %s", err)
+	}
+
+	err = syscall.Chdir(rootfs)
+	if err != nil {
+		return err
+	}
+
+	// pivot the old root to the same place as the new one, so that it can be
+	// detached without needing a directory for it
+	err = syscall.PivotRoot(".", ".")
+	if err != nil {
+		return fmt.Errorf("failed to pivot root: %s", err)
+	}
+
+	err = syscall.Unmount(".", syscall.MNT_DETACH)
+	if err != nil {
+		return fmt.Errorf("failed to detach old root: %s", err)
+	}
+
+	return syscall.Chdir("/")
+}
@@ -0,0 +1,127 @@
+package houdini
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// mountsBeneath returns every mount point at or beneath dir, deepest first, so
+// that they can be unmounted in order.
+func mountsBeneath(dir string) ([]string, error) {
+	mountinfo, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+
+	defer mountinfo.Close()
+
+	dir = filepath.Clean(dir)
+
+	mounts := []string{}
+
+	scanner := bufio.NewScanner(mountinfo)
+	for scanner.Scan() {
+		// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+
+		mountPoint := unescapeMountPath(fields[4])
+		if mountPoint == dir || strings.HasPrefix(mountPoint, dir+"/") {
+			mounts = append(mounts, mountPoint)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(mounts, func(i, j int) bool {
+		return len(mounts[i]) > len(mounts[j])
+	})
+
+	return mounts, nil
+}
+
+// unescapeMountPath decodes the octal escapes (e.g. \040 for space) that
+// mountinfo uses for whitespace and backslashes.
+func unescapeMountPath(path string) string {
+	if !strings.Contains(path, `\`) {
+		return path
+	}
+
+	var unescaped strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+3 < len(path) {
+			code, err := strconv.ParseUint(path[i+1:i+4], 8, 8)
+			if err == nil {
+				unescaped.WriteByte(byte(code))
+				i += 3
+				continue
+			}
+		}
+
+		unescaped.WriteByte(path[i])
+	}
+
+	return unescaped.String()
+}
+
+// unmount unmounts path, lazily detaching it if it's busy.
+func unmount(path string) error {
+	err := syscall.Unmount(path, 0)
+	if err == nil || err == syscall.EINVAL {
+		// EINVAL: not a mount point (anymore)
+		return nil
+	}
+
+	return syscall.Unmount(path, syscall.MNT_DETACH)
+}
+
+// unmountBeneath unmounts everything mounted at or beneath dir.
+func unmountBeneath(dir string) error {
+	mounts, err := mountsBeneath(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, mount := range mounts {
+		err := unmount(mount)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// mountOverlay mounts an overlay of lower in dir, with changes going to an
+// upper dir alongside it, and returns the path to the overlay.
+func mountOverlay(lower string, dir string) (string, error) {
+	upper := filepath.Join(dir, overlayUpperDir)
+	work := filepath.Join(dir, "work")
+	merged := filepath.Join(dir, "merged")
+
+	for _, d := range []string{upper, work, merged} {
+		err := os.MkdirAll(d, 0755)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	data := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", lower, upper, work)
+
+	err := syscall.Mount("overlay", merged, "overlay", 0, data)
+	if err != nil {
+		return "", fmt.Errorf("failed to mount overlay of %s: %s", lower, err)
+	}
+
+	return merged, nil
+}
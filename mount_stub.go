@@ -0,0 +1,19 @@
+// +build !linux
+
+package houdini
+
+import "errors"
+
+// nothing is ever mounted on other platforms
+
+func unmountBeneath(dir string) error {
+	return nil
+}
+
+func unmount(path string) error {
+	return nil
+}
+
+func mountOverlay(lower string, dir string) (string, error) {
+	return "", errors.New("overlay rootfses are only supported on Linux")
+}
@@ -0,0 +1,513 @@
+package houdini
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+
+	"github.com/concourse/go-archive/tarfs"
+)
+
+const (
+	ociRefNameAnnotation = "org.opencontainers.image.ref.name"
+
+	ociWhiteoutPrefix = ".wh."
+	ociOpaqueWhiteout = ".wh..wh..opq"
+
+	ociDefaultTag = "latest"
+)
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *ociPlatform      `json:"platform,omitempty"`
+}
+
+type ociPlatform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+}
+
+type ociIndex struct {
+	MediaType string          `json:"mediaType"`
+	Manifests []ociDescriptor `json:"manifests"`
+}
+
+type ociManifest struct {
+	MediaType string          `json:"mediaType"`
+	Config    ociDescriptor   `json:"config"`
+	Layers    []ociDescriptor `json:"layers"`
+}
+
+// imageConfig is the part of an image's config that houdini uses as defaults
+// for the container and its processes.
+type imageConfig struct {
+	Env        []string `json:"Env"`
+	WorkingDir string   `json:"WorkingDir"`
+	User       string   `json:"User"`
+}
+
+type ociConfig struct {
+	Config imageConfig `json:"config"`
+}
+
+var ociDigestPattern = regexp.MustCompile(`^([a-z0-9]+(?:[+._-][a-z0-9]+)*):([a-zA-Z0-9=_-]+)$`)
+
+// parseOCIRef splits the path of an oci:// URI into the layout directory and
+// the tag, which defaults to latest.
+func parseOCIRef(ref string) (string, string) {
+	colon := strings.LastIndex(ref, ":")
+	if colon == -1 || colon < strings.LastIndex(ref, "/") {
+		return ref, ociDefaultTag
+	}
+
+	return ref[:colon], ref[colon+1:]
+}
+
+// ociImage is an image in an OCI image layout on the host.
+type ociImage struct {
+	layout string
+
+	// the digest of the image's manifest, which identifies the image
+	digest string
+
+	manifest ociManifest
+}
+
+// resolveImage finds the image for an oci:// URI's path.
+func resolveImage(ref string) (ociImage, error) {
+	layout, tag := parseOCIRef(ref)
+
+	desc, manifest, err := resolveOCIManifest(layout, tag)
+	if err != nil {
+		return ociImage{}, err
+	}
+
+	return ociImage{
+		layout: layout,
+		digest: desc.Digest,
+
+		manifest: manifest,
+	}, nil
+}
+
+func (image ociImage) Config() (imageConfig, error) {
+	var config ociConfig
+	err := readOCIBlob(image.layout, image.manifest.Config, &config)
+	if err != nil {
+		return imageConfig{}, fmt.Errorf("failed to read image config: %s", err)
+	}
+
+	return config.Config, nil
+}
+
+// Unpack applies the image's layers, in order, into dest.
+func (image ociImage) Unpack(dest string) error {
+	err := os.MkdirAll(dest, 0755)
+	if err != nil {
+		return err
+	}
+
+	for _, layer := range image.manifest.Layers {
+		err := applyOCILayer(image.layout, layer, dest)
+		if err != nil {
+			return fmt.Errorf("failed to apply layer %s: %s", layer.Digest, err)
+		}
+	}
+
+	return nil
+}
+
+func resolveOCIManifest(layout string, tag string) (ociDescriptor, ociManifest, error) {
+	payload, err := os.ReadFile(filepath.Join(layout, "index.json"))
+	if err != nil {
+		return ociDescriptor{}, ociManifest{}, err
+	}
+
+	var index ociIndex
+	err = json.Unmarshal(payload, &index)
+	if err != nil {
+		return ociDescriptor{}, ociManifest{}, fmt.Errorf("failed to parse index.json: %s", err)
+	}
+
+	var desc *ociDescriptor
+	for i, manifest := range index.Manifests {
+		if manifest.Annotations[ociRefNameAnnotation] == tag {
+			desc = &index.Manifests[i]
+			break
+		}
+	}
+
+	if desc == nil {
+		return ociDescriptor{}, ociManifest{}, fmt.Errorf("tag not found in image layout %s: %s", layout, tag)
+	}
+
+	// an image built for several platforms points at an index of manifests,
+	// one per platform
+	for isOCIIndex(desc.MediaType) {
+		var platforms ociIndex
+		err := readOCIBlob(layout, *desc, &platforms)
+		if err != nil {
+			return ociDescriptor{}, ociManifest{}, err
+		}
+
+		desc, err = selectOCIPlatform(platforms.Manifests)
+		if err != nil {
+			return ociDescriptor{}, ociManifest{}, err
+		}
+	}
+
+	var manifest ociManifest
+	err = readOCIBlob(layout, *desc, &manifest)
+	if err != nil {
+		return ociDescriptor{}, ociManifest{}, err
+	}
+
+	return *desc, manifest, nil
+}
+
+func isOCIIndex(mediaType string) bool {
+	return mediaType == "application/vnd.oci.image.index.v1+json" ||
+		mediaType == "application/vnd.docker.distribution.manifest.list.v2+json"
+}
+
+func selectOCIPlatform(manifests []ociDescriptor) (*ociDescriptor, error) {
+	for i, manifest := range manifests {
+		if manifest.Platform == nil {
+			continue
+		}
+
+		if manifest.Platform.OS == runtime.GOOS && manifest.Platform.Architecture == runtime.GOARCH {
+			return &manifests[i], nil
+		}
+	}
+
+	return nil, fmt.Errorf("no image for platform %s/%s", runtime.GOOS, runtime.GOARCH)
+}
+
+func ociBlobPath(layout string, digest string) (string, error) {
+	match := ociDigestPattern.FindStringSubmatch(digest)
+	if match == nil {
+		return "", fmt.Errorf("invalid digest: %q", digest)
+	}
+
+	return filepath.Join(layout, "blobs", match[1], match[2]), nil
+}
+
+// openOCIBlob opens a blob in the layout. The returned verifier checks the
+// blob's digest once everything has been read from it.
+func openOCIBlob(layout string, desc ociDescriptor) (*os.File, *blobVerifier, error) {
+	blobPath, err := ociBlobPath(layout, desc.Digest)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	file, err := os.Open(blobPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	verifier, err := newBlobVerifier(file, desc.Digest)
+	if err != nil {
+		_ = file.Close()
+		return nil, nil, err
+	}
+
+	return file, verifier, nil
+}
+
+func readOCIBlob(layout string, desc ociDescriptor, dest interface{}) error {
+	file, verifier, err := openOCIBlob(layout, desc)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	payload, err := io.ReadAll(verifier)
+	if err != nil {
+		return err
+	}
+
+	err = verifier.Verify()
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(payload, dest)
+}
+
+type blobVerifier struct {
+	io.Reader
+
+	digest string
+	hash   hash.Hash
+}
+
+func newBlobVerifier(r io.Reader, digest string) (*blobVerifier, error) {
+	if !strings.HasPrefix(digest, "sha256:") {
+		return nil, fmt.Errorf("unsupported digest algorithm: %s", digest)
+	}
+
+	h := sha256.New()
+
+	return &blobVerifier{
+		Reader: io.TeeReader(r, h),
+
+		digest: digest,
+		hash:   h,
+	}, nil
+}
+
+func (verifier *blobVerifier) Verify() error {
+	// account for anything left over, e.g. padding after the end of a tar
+	_, err := io.Copy(io.Discard, verifier.Reader)
+	if err != nil {
+		return err
+	}
+
+	actual := "sha256:" + hex.EncodeToString(verifier.hash.Sum(nil))
+	if actual != verifier.digest {
+		return fmt.Errorf("digest mismatch: expected %s, got %s", verifier.digest, actual)
+	}
+
+	return nil
+}
+
+func ociLayerCompression(mediaType string) (string, error) {
+	switch {
+	case strings.HasSuffix(mediaType, ".tar"):
+		return compressionNone, nil
+	case strings.HasSuffix(mediaType, "+gzip"), strings.HasSuffix(mediaType, ".tar.gzip"):
+		return compressionGzip, nil
+	case strings.HasSuffix(mediaType, "+zstd"):
+		return compressionZstd, nil
+	default:
+		return "", fmt.Errorf("unsupported layer media type: %s", mediaType)
+	}
+}
+
+// applyOCILayer applies a layer on top of what's already in dest. It makes
+// two passes: the first removes whatever the layer's whiteouts remove, and the
+// second extracts the rest of the layer.
+func applyOCILayer(layout string, layer ociDescriptor, dest string) error {
+	compression, err := ociLayerCompression(layer.MediaType)
+	if err != nil {
+		return err
+	}
+
+	err = walkOCILayer(layout, layer, compression, func(hdr *tar.Header, _ io.Reader) error {
+		return applyOCIRemovals(hdr, dest)
+	})
+	if err != nil {
+		return err
+	}
+
+	return walkOCILayer(layout, layer, compression, func(hdr *tar.Header, content io.Reader) error {
+		return extractOCIEntry(hdr, content, dest)
+	})
+}
+
+// extractOCIEntry extracts an entry of a layer on top of the layers beneath
+// it. Symlinks the entry is beneath are followed within the rootfs, e.g. for
+// images where /lib links to /usr/lib, and anything already in the entry's
+// place is replaced rather than written through.
+func extractOCIEntry(hdr *tar.Header, content io.Reader, dest string) error {
+	name := path.Clean("/" + hdr.Name)
+	if name == "/" || strings.HasPrefix(path.Base(name), ociWhiteoutPrefix) {
+		return nil
+	}
+
+	target, err := resolveInRootfs(dest, name)
+	if err != nil {
+		return fmt.Errorf("layer entry %s: %s", hdr.Name, err)
+	}
+
+	info, err := os.Lstat(target)
+	if err == nil && !(info.IsDir() && hdr.Typeflag == tar.TypeDir) {
+		err := os.RemoveAll(target)
+		if err != nil {
+			return err
+		}
+	}
+
+	entry := *hdr
+	entry.Name, err = filepath.Rel(dest, target)
+	if err != nil {
+		return err
+	}
+
+	if hdr.Typeflag == tar.TypeLink {
+		linked, err := resolveInRootfs(dest, hdr.Linkname)
+		if err != nil {
+			return fmt.Errorf("layer entry %s: %s", hdr.Name, err)
+		}
+
+		entry.Linkname, err = filepath.Rel(dest, linked)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tarfs.ExtractEntry(&entry, dest, content, os.Getuid() == 0)
+}
+
+func walkOCILayer(layout string, layer ociDescriptor, compression string, walk func(*tar.Header, io.Reader) error) error {
+	file, verifier, err := openOCIBlob(layout, layer)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	stream, err := decompress(verifier, compression)
+	if err != nil {
+		return err
+	}
+
+	defer stream.Close()
+
+	tr := tar.NewReader(stream)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		err = walk(hdr, tr)
+		if err != nil {
+			return err
+		}
+	}
+
+	return verifier.Verify()
+}
+
+func applyOCIRemovals(hdr *tar.Header, dest string) error {
+	name := path.Clean("/" + hdr.Name)
+	if name == "/" {
+		return nil
+	}
+
+	dir, base := path.Split(name)
+
+	switch {
+	case base == ociOpaqueWhiteout:
+		// hide everything from lower layers in the directory
+		target, err := resolveInRootfs(dest, dir)
+		if err != nil {
+			return err
+		}
+
+		info, err := os.Lstat(target)
+		if err != nil || !info.IsDir() {
+			return nil
+		}
+
+		entries, err := os.ReadDir(target)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+
+			return err
+		}
+
+		for _, entry := range entries {
+			err := os.RemoveAll(filepath.Join(target, entry.Name()))
+			if err != nil {
+				return err
+			}
+		}
+
+	case strings.HasPrefix(base, ociWhiteoutPrefix):
+		target, err := resolveInRootfs(dest, path.Join(dir, strings.TrimPrefix(base, ociWhiteoutPrefix)))
+		if err != nil {
+			return err
+		}
+
+		return os.RemoveAll(target)
+	}
+
+	return nil
+}
+
+// the most symlinks resolveInRootfs follows for a path, as they may loop
+const maxRootfsSymlinks = 255
+
+// resolveInRootfs returns the host path for a path in the rootfs, following
+// any symlinks it is beneath as if the rootfs were the root: absolute links
+// start from the rootfs, and nothing can go up out of it. The last component
+// of the path is not followed, as whatever is there is what's being replaced
+// or removed.
+func resolveInRootfs(rootfs string, name string) (string, error) {
+	resolved := "/"
+	remaining := strings.Split(name, "/")
+
+	links := 0
+	for len(remaining) > 0 {
+		segment := remaining[0]
+		remaining = remaining[1:]
+
+		switch segment {
+		case "", ".":
+			continue
+		case "..":
+			resolved = path.Dir(resolved)
+			continue
+		}
+
+		next := path.Join(resolved, segment)
+
+		if len(remaining) == 0 {
+			resolved = next
+			break
+		}
+
+		info, err := os.Lstat(filepath.Join(rootfs, filepath.FromSlash(next)))
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			// nothing beneath it exists yet if it doesn't, so nor do any symlinks
+			resolved = next
+			continue
+		}
+
+		links++
+		if links > maxRootfsSymlinks {
+			return "", fmt.Errorf("too many symlinks in %s", name)
+		}
+
+		link, err := os.Readlink(filepath.Join(rootfs, filepath.FromSlash(next)))
+		if err != nil {
+			return "", err
+		}
+
+		if path.IsAbs(link) {
+			resolved = "/"
+		}
+
+		remaining = append(strings.Split(link, "/"), remaining...)
+	}
+
+	return filepath.Join(rootfs, filepath.FromSlash(resolved)), nil
+}
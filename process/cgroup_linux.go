@@ -0,0 +1,45 @@
+package process
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+)
+
+// shimCgroup translates the cgroup fd the process is to be started in, which
+// means nothing to the shim, into the cgroup's path.
+func shimCgroup(attr *syscall.SysProcAttr) (*syscall.SysProcAttr, string, error) {
+	if attr == nil || !attr.UseCgroupFD {
+		return attr, "", nil
+	}
+
+	path, err := os.Readlink(fmt.Sprintf("/proc/self/fd/%d", attr.CgroupFD))
+	if err != nil {
+		return nil, "", err
+	}
+
+	shimAttr := *attr
+	shimAttr.UseCgroupFD = false
+	shimAttr.CgroupFD = 0
+
+	return &shimAttr, path, nil
+}
+
+// useCgroup has the process started in the cgroup at path. The returned
+// closer must be kept open until it has started.
+func useCgroup(attr *syscall.SysProcAttr, path string) (*syscall.SysProcAttr, io.Closer, error) {
+	dir, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if attr == nil {
+		attr = &syscall.SysProcAttr{}
+	}
+
+	attr.UseCgroupFD = true
+	attr.CgroupFD = int(dir.Fd())
+
+	return attr, dir, nil
+}
@@ -0,0 +1,17 @@
+// +build !linux,!windows
+
+package process
+
+import (
+	"errors"
+	"io"
+	"syscall"
+)
+
+func shimCgroup(attr *syscall.SysProcAttr) (*syscall.SysProcAttr, string, error) {
+	return attr, "", nil
+}
+
+func useCgroup(attr *syscall.SysProcAttr, path string) (*syscall.SysProcAttr, io.Closer, error) {
+	return nil, nil, errors.New("cgroups are only supported on Linux")
+}
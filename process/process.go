@@ -1,8 +1,10 @@
 package process
 
 import (
+	"io"
 	"os/exec"
 	"sync"
+	"time"
 
 	"code.cloudfoundry.org/garden"
 )
@@ -11,6 +13,12 @@ type process interface {
 	Signal(garden.Signal) error
 	Wait() (int, error)
 	SetWindowSize(garden.WindowSize) error
+	Pid() int
+}
+
+// detachable is a process that can be let go of without stopping it.
+type detachable interface {
+	detach() error
 }
 
 type Process struct {
@@ -18,6 +26,10 @@ type Process struct {
 
 	process process
 
+	// when the process started, if known, to tell it apart from whatever is
+	// given its pid once it's gone
+	startedAt time.Time
+
 	waiting    *sync.Once
 	exitStatus int
 	exitErr    error
@@ -62,8 +74,18 @@ func (p *Process) SetTTY(tty garden.TTYSpec) error {
 	return nil
 }
 
+// spawnFunc starts or reconnects to a process, sending its output to stdout
+// and stderr and returning a writer for its input.
+type spawnFunc func(stdout io.Writer, stderr io.Writer) (process, io.WriteCloser, error)
+
 func (p *Process) Start(cmd *exec.Cmd, tty *garden.TTYSpec) error {
-	process, stdin, err := spawn(cmd, tty, p.stdout, p.stderr)
+	return p.start(func(stdout io.Writer, stderr io.Writer) (process, io.WriteCloser, error) {
+		return spawn(cmd, tty, stdout, stderr)
+	})
+}
+
+func (p *Process) start(spawn spawnFunc) error {
+	process, stdin, err := spawn(p.stdout, p.stderr)
 	if err != nil {
 		return err
 	}
@@ -72,9 +94,26 @@ func (p *Process) Start(cmd *exec.Cmd, tty *garden.TTYSpec) error {
 
 	p.process = process
 
+	p.startedAt, _ = startTime(process.Pid())
+
 	return nil
 }
 
+func (p *Process) Pid() int {
+	return p.process.Pid()
+}
+
+// running reports whether the process's pid still belongs to it.
+func (p *Process) running() bool {
+	if p.startedAt.IsZero() {
+		// there's no telling, so assume that it does
+		return true
+	}
+
+	started, err := startTime(p.Pid())
+	return err == nil && started.Equal(p.startedAt)
+}
+
 func (p *Process) Attach(processIO garden.ProcessIO) {
 	if processIO.Stdin != nil {
 		p.stdin.AddSource(processIO.Stdin)
@@ -92,3 +131,20 @@ func (p *Process) Attach(processIO garden.ProcessIO) {
 func (p *Process) Signal(signal garden.Signal) error {
 	return p.process.Signal(signal)
 }
+
+func (p *Process) detach() error {
+	process, ok := p.process.(detachable)
+	if !ok {
+		return nil
+	}
+
+	return process.detach()
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
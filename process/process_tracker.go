@@ -1,8 +1,14 @@
 package process
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -13,16 +19,26 @@ import (
 type ProcessTracker interface {
 	Run(string, *exec.Cmd, garden.ProcessIO, *garden.TTYSpec) (garden.Process, error)
 	Attach(string, garden.ProcessIO) (garden.Process, error)
-	Restore(processID string)
+	Restore(processID string) error
 	ActiveProcesses() []garden.Process
+	Usage() (Usage, error)
+	Kill() error
 	Stop(kill bool) error
+	Detach() error
 }
 
 type processTracker struct {
+	dir      string
+	shimPath string
+
 	processes      map[string]*Process
 	processesMutex *sync.RWMutex
 }
 
+// ErrDetached is returned when waiting on a process whose shim hung up
+// without reporting an exit status. The process may still be running.
+var ErrDetached = errors.New("detached from process before it exited")
+
 type UnknownProcessError struct {
 	ProcessID string
 }
@@ -31,8 +47,26 @@ func (e UnknownProcessError) Error() string {
 	return fmt.Sprintf("unknown process: %s", e.ProcessID)
 }
 
-func NewTracker() ProcessTracker {
+// NewTracker returns a ProcessTracker which records the processes it spawns
+// under dir, so that they can be restored by a later tracker. If dir is empty
+// nothing is recorded.
+func NewTracker(dir string) ProcessTracker {
 	return &processTracker{
+		dir: dir,
+
+		processes:      make(map[string]*Process),
+		processesMutex: new(sync.RWMutex),
+	}
+}
+
+// NewShimTracker returns a ProcessTracker which spawns each process through
+// the shim at shimPath. The shim owns the process and its stdio, so the
+// process outlives the tracker and can be fully restored by a later one.
+func NewShimTracker(dir string, shimPath string) ProcessTracker {
+	return &processTracker{
+		dir:      dir,
+		shimPath: shimPath,
+
 		processes:      make(map[string]*Process),
 		processesMutex: new(sync.RWMutex),
 	}
@@ -56,13 +90,26 @@ func (t *processTracker) Run(passedID string, cmd *exec.Cmd, processIO garden.Pr
 
 	process.Attach(processIO)
 
-	err := process.Start(cmd, tty)
+	var err error
+	if t.shimPath != "" {
+		err = process.start(shimSpawner(t.shimPath, filepath.Join(t.dir, processID), cmd, tty))
+	} else {
+		err = process.Start(cmd, tty)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = t.record(process)
 	if err != nil {
+		process.Signal(garden.SignalKill)
 		return nil, err
 	}
 
 	t.processes[processID] = process
 
+	go t.waitAndReap(processID)
+
 	return process, nil
 }
 
@@ -82,16 +129,55 @@ func (t *processTracker) Attach(processID string, processIO garden.ProcessIO) (g
 	return process, nil
 }
 
-func (t *processTracker) Restore(processID string) {
-	t.processesMutex.Lock()
+func (t *processTracker) Restore(processID string) error {
+	processDir := filepath.Join(t.dir, processID)
+	pidFile := filepath.Join(processDir, "pid")
+
+	info, err := os.Stat(pidFile)
+	if err != nil {
+		return err
+	}
+
+	pidStr, err := os.ReadFile(pidFile)
+	if err != nil {
+		return err
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(pidStr)))
+	if err != nil {
+		return fmt.Errorf("malformed pid file %s: %s", pidFile, err)
+	}
+
+	startedAt, err := readStartTime(processDir)
+	if err != nil {
+		return err
+	}
 
 	process := NewProcess(processID)
 
+	_, err = os.Stat(filepath.Join(processDir, shimSpecFile))
+	if err == nil {
+		err = process.start(shimRestorer(processDir, pid))
+	} else {
+		err = process.start(restorer(pid, info.ModTime(), startedAt))
+	}
+	if err != nil {
+		// the process exited while nobody was tracking it
+		os.RemoveAll(processDir)
+		return err
+	}
+
+	t.processesMutex.Lock()
+
 	t.processes[processID] = process
 
+	t.processesMutex.Unlock()
+
+	t.forgetOnExit(process)
+
 	go t.waitAndReap(processID)
 
-	t.processesMutex.Unlock()
+	return nil
 }
 
 func (t *processTracker) ActiveProcesses() []garden.Process {
@@ -109,6 +195,56 @@ func (t *processTracker) ActiveProcesses() []garden.Process {
 	return processes
 }
 
+func (t *processTracker) Usage() (Usage, error) {
+	return TreeUsage(t.pids())
+}
+
+// Kill kills every process along with all of their descendants, without
+// waiting for them to exit.
+func (t *processTracker) Kill() error {
+	pids := []int{}
+
+	err := walkTree(t.pids(), func(proc procInfo) {
+		pids = append(pids, proc.pid)
+	})
+	if err == ErrUsageUnsupported {
+		// the descendants can't be found, so make do with the processes
+		pids = t.pids()
+	} else if err != nil {
+		return err
+	}
+
+	for _, pid := range pids {
+		proc, err := os.FindProcess(pid)
+		if err != nil {
+			continue
+		}
+
+		// may have exited in the meantime
+		_ = proc.Kill()
+	}
+
+	return nil
+}
+
+func (t *processTracker) pids() []int {
+	t.processesMutex.RLock()
+	defer t.processesMutex.RUnlock()
+
+	pids := []int{}
+	for _, process := range t.processes {
+		// it may have exited and had its pid given to another process before
+		// being reaped
+		if !process.running() {
+			continue
+		}
+
+		pids = append(pids, process.Pid())
+	}
+
+	return pids
+}
+
 func (t *processTracker) Stop(kill bool) error {
 	t.processesMutex.RLock()
 
@@ -154,6 +290,99 @@ func (t *processTracker) Stop(kill bool) error {
 	return nil
 }
 
+// Detach lets go of every process without stopping it, hanging up on the
+// shims of those run through one so that a later tracker can reattach to
+// them.
+func (t *processTracker) Detach() error {
+	t.processesMutex.RLock()
+	defer t.processesMutex.RUnlock()
+
+	for _, process := range t.processes {
+		err := process.detach()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (t *processTracker) record(process *Process) error {
+	if t.dir == "" {
+		return nil
+	}
+
+	processDir := filepath.Join(t.dir, process.ID())
+
+	err := os.MkdirAll(processDir, 0755)
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(
+		filepath.Join(processDir, "pid"),
+		[]byte(strconv.Itoa(process.Pid())),
+		0644,
+	)
+	if err != nil {
+		return err
+	}
+
+	if !process.startedAt.IsZero() {
+		err = os.WriteFile(
+			filepath.Join(processDir, startTimeFile),
+			[]byte(strconv.FormatInt(process.startedAt.UnixNano(), 10)),
+			0644,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	t.forgetOnExit(process)
+
+	return nil
+}
+
+// where a process's start time is recorded, alongside its pid, to tell it
+// apart from whatever is given the pid once it's gone
+const startTimeFile = "started"
+
+// readStartTime reads the start time recorded for a process, returning the
+// zero time if none was.
+func readStartTime(processDir string) (time.Time, error) {
+	path := filepath.Join(processDir, startTimeFile)
+
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return time.Time{}, nil
+	}
+
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	nanos, err := strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("malformed start time file %s: %s", path, err)
+	}
+
+	return time.Unix(0, nanos), nil
+}
+
+// forgetOnExit removes the process's record once it has exited, so that it is
+// not restored.
+func (t *processTracker) forgetOnExit(process *Process) {
+	go func() {
+		_, err := process.Wait()
+		if err == ErrDetached {
+			return
+		}
+
+		os.RemoveAll(filepath.Join(t.dir, process.ID()))
+	}()
+}
+
 func (t *processTracker) waitAndReap(processID string) {
 	t.processesMutex.RLock()
 	process, ok := t.processes[processID]
@@ -174,3 +403,28 @@ func (t *processTracker) unregister(processID string) {
 
 	delete(t.processes, processID)
 }
+
+func shimSpawner(shimPath string, processDir string, cmd *exec.Cmd, tty *garden.TTYSpec) spawnFunc {
+	return func(stdout io.Writer, stderr io.Writer) (process, io.WriteCloser, error) {
+		return spawnShim(shimPath, processDir, cmd, tty, stdout, stderr)
+	}
+}
+
+func shimRestorer(processDir string, pid int) spawnFunc {
+	return func(stdout io.Writer, stderr io.Writer) (process, io.WriteCloser, error) {
+		return restoreShim(processDir, pid, stdout, stderr)
+	}
+}
+
+// restorer adopts a process spawned directly by a previous tracker. Its stdio
+// went away with that tracker, so input is discarded and no output arrives.
+func restorer(pid int, spawnedAt time.Time, startedAt time.Time) spawnFunc {
+	return func(io.Writer, io.Writer) (process, io.WriteCloser, error) {
+		proc, err := restore(pid, spawnedAt, startedAt)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return proc, nopWriteCloser{io.Discard}, nil
+	}
+}
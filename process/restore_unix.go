@@ -0,0 +1,94 @@
+// +build !windows
+
+package process
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"time"
+
+	"code.cloudfoundry.org/garden"
+)
+
+// ErrUnknownExitStatus is returned when waiting on a restored process. It is
+// not a child of this process, so its exit status cannot be collected.
+var ErrUnknownExitStatus = errors.New("exit status of restored process is unknown")
+
+const restoredPollInterval = time.Second
+
+// process start times are only known to within a second or so
+const startTimeSlack = 2 * time.Second
+
+// restore adopts the process with the given pid, which was recorded at
+// spawnedBy, along with when it started if that was known.
+func restore(pid int, spawnedBy time.Time, startedAt time.Time) (process, error) {
+	err := syscall.Kill(pid, 0)
+	if err != nil {
+		return nil, fmt.Errorf("process %d is gone: %s", pid, err)
+	}
+
+	started, err := startTime(pid)
+	if err != nil {
+		return nil, err
+	}
+
+	// a process that started at any other time, or after it was recorded, is
+	// an unrelated process that happens to have been given the same pid
+	if !startedAt.IsZero() && !started.Equal(startedAt) {
+		return nil, fmt.Errorf("process %d is gone: pid has been reused", pid)
+	}
+
+	if started.After(spawnedBy.Add(startTimeSlack)) {
+		return nil, fmt.Errorf("process %d is gone: pid has been reused", pid)
+	}
+
+	return &restoredProcess{pid: pid, startedAt: started}, nil
+}
+
+type restoredProcess struct {
+	pid int
+
+	// to tell the process apart from whatever is given its pid once it's gone
+	startedAt time.Time
+}
+
+// running reports whether the pid still belongs to the process.
+func (proc *restoredProcess) running() bool {
+	if syscall.Kill(proc.pid, 0) != nil {
+		return false
+	}
+
+	started, err := startTime(proc.pid)
+	return err == nil && started.Equal(proc.startedAt)
+}
+
+func (proc *restoredProcess) Signal(signal garden.Signal) error {
+	// it has exited, and its pid may be some other process's by now
+	if !proc.running() {
+		return nil
+	}
+
+	switch signal {
+	case garden.SignalTerminate:
+		return syscall.Kill(proc.pid, syscall.SIGTERM)
+	default:
+		return syscall.Kill(proc.pid, syscall.SIGKILL)
+	}
+}
+
+func (proc *restoredProcess) Wait() (int, error) {
+	for proc.running() {
+		time.Sleep(restoredPollInterval)
+	}
+
+	return -1, ErrUnknownExitStatus
+}
+
+func (proc *restoredProcess) Pid() int {
+	return proc.pid
+}
+
+func (proc *restoredProcess) SetWindowSize(garden.WindowSize) error {
+	return nil
+}
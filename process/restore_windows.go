@@ -0,0 +1,82 @@
+package process
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+
+	"code.cloudfoundry.org/garden"
+)
+
+const processSynchronize = 0x00100000
+
+// process start times are only known to within a second or so
+const startTimeSlack = 2 * time.Second
+
+// restore adopts the process with the given pid, which was recorded at
+// spawnedBy, along with when it started if that was known.
+func restore(pid int, spawnedBy time.Time, startedAt time.Time) (process, error) {
+	handle, err := syscall.OpenProcess(
+		processSynchronize|syscall.PROCESS_QUERY_INFORMATION|syscall.PROCESS_TERMINATE,
+		false,
+		uint32(pid),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("process %d is gone: %s", pid, err)
+	}
+
+	var u syscall.Rusage
+	err = syscall.GetProcessTimes(handle, &u.CreationTime, &u.ExitTime, &u.KernelTime, &u.UserTime)
+	if err != nil {
+		syscall.CloseHandle(handle)
+		return nil, os.NewSyscallError("GetProcessTimes", err)
+	}
+
+	// a process that started at any other time, or after it was recorded, is
+	// an unrelated process that happens to have been given the same pid
+	started := time.Unix(0, u.CreationTime.Nanoseconds())
+	if (!startedAt.IsZero() && !started.Equal(startedAt)) || started.After(spawnedBy.Add(startTimeSlack)) {
+		syscall.CloseHandle(handle)
+		return nil, fmt.Errorf("process %d is gone: pid has been reused", pid)
+	}
+
+	return &restoredProcess{
+		processHandle: handle,
+		pid:           pid,
+	}, nil
+}
+
+type restoredProcess struct {
+	processHandle syscall.Handle
+	pid           int
+}
+
+func (process *restoredProcess) Signal(garden.Signal) error {
+	return syscall.TerminateProcess(process.processHandle, 1)
+}
+
+func (process *restoredProcess) Wait() (int, error) {
+	s, e := syscall.WaitForSingleObject(process.processHandle, syscall.INFINITE)
+	if s == syscall.WAIT_FAILED {
+		return -1, os.NewSyscallError("WaitForSingleObject", e)
+	}
+
+	defer syscall.CloseHandle(process.processHandle)
+
+	var ec uint32
+	e = syscall.GetExitCodeProcess(process.processHandle, &ec)
+	if e != nil {
+		return -1, os.NewSyscallError("GetExitCodeProcess", e)
+	}
+
+	return int(ec), nil
+}
+
+func (process *restoredProcess) Pid() int {
+	return process.pid
+}
+
+func (process *restoredProcess) SetWindowSize(garden.WindowSize) error {
+	return nil
+}
@@ -0,0 +1,374 @@
+// +build !windows
+
+package process
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"code.cloudfoundry.org/garden"
+)
+
+// A process started through the shim lives in its own directory, which the
+// shim owns for the lifetime of the process:
+//
+//	spec.json  the command to run, written before the shim starts
+//	shim.sock  stdio and control, served by the shim while the process runs,
+//	           and left behind once it exits
+//	exitcode   the process's exit status, written by the shim when it exits
+//	shim.log   anything the shim itself has to complain about
+const (
+	shimSpecFile     = "spec.json"
+	shimSocketFile   = "shim.sock"
+	shimExitCodeFile = "exitcode"
+	shimLogFile      = "shim.log"
+)
+
+const (
+	frameStdin byte = iota
+	frameStdinEOF
+	frameStdout
+	frameStderr
+	frameSignal
+	frameWindowSize
+)
+
+// the longest path that fits in a sockaddr_un on every supported platform
+const maxSocketPath = 100
+
+type shimSpec struct {
+	Path        string               `json:"path"`
+	Args        []string             `json:"args"`
+	Env         []string             `json:"env"`
+	Dir         string               `json:"dir"`
+	SysProcAttr *syscall.SysProcAttr `json:"sys_proc_attr,omitempty"`
+	TTY         *garden.TTYSpec      `json:"tty,omitempty"`
+
+	// the cgroup to start the process in, if any
+	Cgroup string `json:"cgroup,omitempty"`
+}
+
+// shimStatus is written by the shim to its stdout once it is listening for
+// the server, so that the server can connect before the process starts and
+// miss none of its output, and again once the process has started, or failed
+// to.
+type shimStatus struct {
+	Listening bool   `json:"listening,omitempty"`
+	Pid       int    `json:"pid,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+func spawnShim(shimPath string, processDir string, cmd *exec.Cmd, tty *garden.TTYSpec, stdout io.Writer, stderr io.Writer) (process, io.WriteCloser, error) {
+	if cmd.Err != nil {
+		return nil, nil, cmd.Err
+	}
+
+	attr, cgroup, err := shimCgroup(cmd.SysProcAttr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	spec, err := json.Marshal(shimSpec{
+		Path:        cmd.Path,
+		Args:        cmd.Args,
+		Env:         cmd.Env,
+		Dir:         cmd.Dir,
+		SysProcAttr: attr,
+		TTY:         tty,
+		Cgroup:      cgroup,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = os.MkdirAll(processDir, 0755)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = os.WriteFile(filepath.Join(processDir, shimSpecFile), spec, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	log, err := os.Create(filepath.Join(processDir, shimLogFile))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer log.Close()
+
+	shim := exec.Command(shimPath, processDir)
+	shim.Stderr = log
+
+	// put the shim in its own session so that it isn't taken down along with
+	// the server
+	shim.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+
+	statusOut, err := shim.StdoutPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = shim.Start()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// reap the shim whenever it exits; the process's status comes from the
+	// exitcode file, not from the shim
+	defer func() { go shim.Wait() }()
+
+	statuses := json.NewDecoder(bufio.NewReader(statusOut))
+
+	status, err := readShimStatus(statuses, processDir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the shim doesn't start the process until it's connected to
+	conn, err := dialUnix(filepath.Join(processDir, shimSocketFile))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	status, err = readShimStatus(statuses, processDir)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	return attachShim(conn, processDir, status.Pid, stdout, stderr)
+}
+
+func readShimStatus(statuses *json.Decoder, processDir string) (shimStatus, error) {
+	var status shimStatus
+	err := statuses.Decode(&status)
+	if err != nil {
+		return shimStatus{}, fmt.Errorf("shim failed to start (see %s): %s", filepath.Join(processDir, shimLogFile), err)
+	}
+
+	if status.Error != "" {
+		return shimStatus{}, errors.New(status.Error)
+	}
+
+	return status, nil
+}
+
+func restoreShim(processDir string, pid int, stdout io.Writer, stderr io.Writer) (process, io.WriteCloser, error) {
+	status, err := readExitCode(processDir)
+	if err == nil {
+		return &exitedProcess{pid: pid, status: status}, nopWriteCloser{io.Discard}, nil
+	}
+
+	if !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+
+	conn, err := dialUnix(filepath.Join(processDir, shimSocketFile))
+	if err != nil {
+		// it may have exited since the exit status was looked for
+		status, statusErr := readExitCode(processDir)
+		if statusErr == nil {
+			return &exitedProcess{pid: pid, status: status}, nopWriteCloser{io.Discard}, nil
+		}
+
+		return nil, nil, err
+	}
+
+	return attachShim(conn, processDir, pid, stdout, stderr)
+}
+
+func attachShim(conn net.Conn, processDir string, pid int, stdout io.Writer, stderr io.Writer) (process, io.WriteCloser, error) {
+	proc := &shimProcess{
+		dir:  processDir,
+		pid:  pid,
+		conn: conn,
+		done: make(chan struct{}),
+	}
+
+	go proc.readOutput(stdout, stderr)
+
+	return proc, &frameWriter{proc: proc}, nil
+}
+
+// dialUnix connects to a unix socket, working around the length limit on
+// socket paths by dialing through a short symlink if necessary.
+func dialUnix(path string) (net.Conn, error) {
+	if len(path) <= maxSocketPath {
+		return net.Dial("unix", path)
+	}
+
+	linkDir, err := os.MkdirTemp("", "houdini-shim")
+	if err != nil {
+		return nil, err
+	}
+
+	defer os.RemoveAll(linkDir)
+
+	link := filepath.Join(linkDir, "sock")
+
+	err = os.Symlink(path, link)
+	if err != nil {
+		return nil, err
+	}
+
+	return net.Dial("unix", link)
+}
+
+func readExitCode(processDir string) (int, error) {
+	content, err := os.ReadFile(filepath.Join(processDir, shimExitCodeFile))
+	if err != nil {
+		return -1, err
+	}
+
+	return strconv.Atoi(strings.TrimSpace(string(content)))
+}
+
+type shimProcess struct {
+	dir string
+	pid int
+
+	conn   net.Conn
+	writeL sync.Mutex
+
+	done chan struct{}
+}
+
+func (proc *shimProcess) Signal(signal garden.Signal) error {
+	return proc.send(frameSignal, []byte{byte(signal)})
+}
+
+func (proc *shimProcess) Wait() (int, error) {
+	<-proc.done
+
+	status, err := readExitCode(proc.dir)
+	if err != nil {
+		// either the shim died, or another tracker connected to it
+		return -1, ErrDetached
+	}
+
+	return status, nil
+}
+
+func (proc *shimProcess) Pid() int {
+	return proc.pid
+}
+
+// detach hangs up on the shim, which keeps the process running.
+func (proc *shimProcess) detach() error {
+	return proc.conn.Close()
+}
+
+func (proc *shimProcess) SetWindowSize(size garden.WindowSize) error {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint16(payload[0:], uint16(size.Columns))
+	binary.BigEndian.PutUint16(payload[2:], uint16(size.Rows))
+
+	return proc.send(frameWindowSize, payload)
+}
+
+func (proc *shimProcess) send(kind byte, payload []byte) error {
+	proc.writeL.Lock()
+	defer proc.writeL.Unlock()
+
+	return writeFrame(proc.conn, kind, payload)
+}
+
+func (proc *shimProcess) readOutput(stdout io.Writer, stderr io.Writer) {
+	defer close(proc.done)
+	defer proc.conn.Close()
+
+	for {
+		kind, payload, err := readFrame(proc.conn)
+		if err != nil {
+			// the shim hangs up once the process has exited
+			return
+		}
+
+		switch kind {
+		case frameStdout:
+			stdout.Write(payload)
+		case frameStderr:
+			stderr.Write(payload)
+		}
+	}
+}
+
+type frameWriter struct {
+	proc *shimProcess
+}
+
+func (w *frameWriter) Write(data []byte) (int, error) {
+	err := w.proc.send(frameStdin, data)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(data), nil
+}
+
+func (w *frameWriter) Close() error {
+	return w.proc.send(frameStdinEOF, nil)
+}
+
+type exitedProcess struct {
+	pid    int
+	status int
+}
+
+func (proc *exitedProcess) Signal(garden.Signal) error {
+	return nil
+}
+
+func (proc *exitedProcess) Wait() (int, error) {
+	return proc.status, nil
+}
+
+func (proc *exitedProcess) Pid() int {
+	return proc.pid
+}
+
+func (proc *exitedProcess) SetWindowSize(garden.WindowSize) error {
+	return nil
+}
+
+func writeFrame(w io.Writer, kind byte, payload []byte) error {
+	frame := make([]byte, 5+len(payload))
+	frame[0] = kind
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(payload)))
+	copy(frame[5:], payload)
+
+	_, err := w.Write(frame)
+	return err
+}
+
+func readFrame(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, 5)
+
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint32(header[1:]))
+
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return header[0], payload, nil
+}
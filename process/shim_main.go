@@ -0,0 +1,281 @@
+// +build !windows
+
+package process
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/garden"
+)
+
+// how long to wait for output to drain after the process exits, in case it
+// left children behind holding its stdio open
+const shimDrainTimeout = time.Second
+
+// how long to wait for the server to connect before starting the process,
+// after which it's assumed to have gone away
+const shimConnectTimeout = 30 * time.Second
+
+// RunShim is the entrypoint of the shim. It waits for the server to connect,
+// runs the process described by the spec in processDir, serves its stdio until
+// it exits, and records its exit status.
+func RunShim(processDir string) error {
+	err := os.Chdir(processDir)
+	if err != nil {
+		return err
+	}
+
+	payload, err := os.ReadFile(shimSpecFile)
+	if err != nil {
+		return err
+	}
+
+	var spec shimSpec
+	err = json.Unmarshal(payload, &spec)
+	if err != nil {
+		return err
+	}
+
+	// listen on a relative path, as the absolute one may be too long for a
+	// socket address
+	listener, err := net.Listen("unix", shimSocketFile)
+	if err != nil {
+		return err
+	}
+
+	// leave the socket behind once the process has exited, so that whoever
+	// connects to it late is refused rather than finding nothing there, and
+	// knows to look for the exit status instead
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	defer listener.Close()
+
+	status := json.NewEncoder(os.Stdout)
+
+	err = status.Encode(shimStatus{Listening: true})
+	if err != nil {
+		return err
+	}
+
+	// don't start the process until the server is there to see its output
+	err = listener.(*net.UnixListener).SetDeadline(time.Now().Add(shimConnectTimeout))
+	if err != nil {
+		return err
+	}
+
+	client, err := listener.Accept()
+	if err != nil {
+		return status.Encode(shimStatus{Error: fmt.Sprintf("server never connected: %s", err)})
+	}
+
+	err = listener.(*net.UnixListener).SetDeadline(time.Time{})
+	if err != nil {
+		return err
+	}
+
+	stdoutR, stdoutW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+
+	stderrR, stderrW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+
+	cmd := &exec.Cmd{
+		Path:        spec.Path,
+		Args:        spec.Args,
+		Env:         spec.Env,
+		Dir:         spec.Dir,
+		SysProcAttr: spec.SysProcAttr,
+	}
+
+	var cgroupDir io.Closer
+	if spec.Cgroup != "" {
+		cmd.SysProcAttr, cgroupDir, err = useCgroup(cmd.SysProcAttr, spec.Cgroup)
+		if err != nil {
+			return status.Encode(shimStatus{Error: err.Error()})
+		}
+	}
+
+	proc, stdin, err := spawn(cmd, spec.TTY, stdoutW, stderrW)
+
+	// the process is in the cgroup once it has started
+	if cgroupDir != nil {
+		cgroupDir.Close()
+	}
+
+	if err != nil {
+		return status.Encode(shimStatus{Error: err.Error()})
+	}
+
+	if spec.TTY == nil {
+		stdoutW.Close()
+	}
+
+	// with a tty, stdout is closed once the pty is drained and stderr is
+	// never used
+	stderrW.Close()
+
+	err = status.Encode(shimStatus{Pid: proc.Pid()})
+	if err != nil {
+		return err
+	}
+
+	// nobody is listening anymore
+	os.Stdout.Close()
+
+	shim := &shim{
+		process: proc,
+		stdin:   stdin,
+		client:  client,
+	}
+
+	go shim.handle(client)
+
+	drained := new(sync.WaitGroup)
+	drained.Add(2)
+	go shim.forward(frameStdout, stdoutR, drained)
+	go shim.forward(frameStderr, stderrR, drained)
+
+	go shim.serve(listener)
+
+	exitStatus, _ := proc.Wait()
+
+	allDrained := make(chan struct{})
+	go func() {
+		drained.Wait()
+		close(allDrained)
+	}()
+
+	select {
+	case <-allDrained:
+	case <-time.After(shimDrainTimeout):
+	}
+
+	err = os.WriteFile(shimExitCodeFile+".tmp", []byte(strconv.Itoa(exitStatus)), 0644)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(shimExitCodeFile+".tmp", shimExitCodeFile)
+	if err != nil {
+		return err
+	}
+
+	listener.Close()
+
+	shim.hangUp()
+
+	return nil
+}
+
+type shim struct {
+	process process
+	stdin   io.WriteCloser
+
+	client  net.Conn
+	clientL sync.Mutex
+}
+
+// serve accepts connections from the server. Only one client is served at a
+// time; a new connection replaces the old one, e.g. when the server restarts.
+func (shim *shim) serve(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		shim.clientL.Lock()
+
+		if shim.client != nil {
+			shim.client.Close()
+		}
+
+		shim.client = conn
+
+		shim.clientL.Unlock()
+
+		go shim.handle(conn)
+	}
+}
+
+func (shim *shim) handle(conn net.Conn) {
+	for {
+		kind, payload, err := readFrame(conn)
+		if err != nil {
+			return
+		}
+
+		switch kind {
+		case frameStdin:
+			shim.stdin.Write(payload)
+
+		case frameStdinEOF:
+			shim.stdin.Close()
+
+		case frameSignal:
+			if len(payload) == 1 {
+				shim.process.Signal(garden.Signal(payload[0]))
+			}
+
+		case frameWindowSize:
+			if len(payload) == 4 {
+				shim.process.SetWindowSize(garden.WindowSize{
+					Columns: int(binary.BigEndian.Uint16(payload[0:])),
+					Rows:    int(binary.BigEndian.Uint16(payload[2:])),
+				})
+			}
+		}
+	}
+}
+
+// forward sends output to the current client. Output produced while no client
+// is connected, i.e. while the server is restarting, is dropped.
+func (shim *shim) forward(kind byte, output io.Reader, drained *sync.WaitGroup) {
+	defer drained.Done()
+
+	buf := make([]byte, 32*1024)
+
+	for {
+		n, err := output.Read(buf)
+		if n > 0 {
+			shim.clientL.Lock()
+
+			if shim.client != nil {
+				if writeFrame(shim.client, kind, buf[:n]) != nil {
+					shim.client.Close()
+					shim.client = nil
+				}
+			}
+
+			shim.clientL.Unlock()
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (shim *shim) hangUp() {
+	shim.clientL.Lock()
+
+	if shim.client != nil {
+		shim.client.Close()
+		shim.client = nil
+	}
+
+	shim.clientL.Unlock()
+}
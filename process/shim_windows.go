@@ -0,0 +1,25 @@
+package process
+
+import (
+	"errors"
+	"io"
+	"os/exec"
+
+	"code.cloudfoundry.org/garden"
+)
+
+const shimSpecFile = "spec.json"
+
+var errShimUnsupported = errors.New("the process shim is not supported on Windows")
+
+func spawnShim(shimPath string, processDir string, cmd *exec.Cmd, tty *garden.TTYSpec, stdout io.Writer, stderr io.Writer) (process, io.WriteCloser, error) {
+	return nil, nil, errShimUnsupported
+}
+
+func restoreShim(processDir string, pid int, stdout io.Writer, stderr io.Writer) (process, io.WriteCloser, error) {
+	return nil, nil, errShimUnsupported
+}
+
+func RunShim(processDir string) error {
+	return errShimUnsupported
+}
@@ -44,7 +44,14 @@ func spawn(cmd *exec.Cmd, ttySpec *garden.TTYSpec, stdout io.Writer, stderr io.W
 		cmd.Stdout = tty
 		cmd.Stderr = tty
 
-		go io.Copy(stdout, pty)
+		go func() {
+			io.Copy(stdout, pty)
+
+			// let the writer know the output has ended, if it cares
+			if closer, ok := stdout.(io.Closer); ok {
+				closer.Close()
+			}
+		}()
 	} else {
 		stdin, err = cmd.StdinPipe()
 		if err != nil {
@@ -93,6 +100,10 @@ func (proc *groupProcess) Wait() (int, error) {
 	return state.Sys().(syscall.WaitStatus).ExitStatus(), nil
 }
 
+func (proc *groupProcess) Pid() int {
+	return proc.process.Pid
+}
+
 func (process *groupProcess) SetWindowSize(size garden.WindowSize) error {
 	if process.processPty != nil {
 		return ptyutil.SetWinSize(process.processPty, size.Columns, size.Rows)
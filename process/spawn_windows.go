@@ -147,12 +147,14 @@ func spawn(cmd *exec.Cmd, _ *garden.TTYSpec, stdout io.Writer, stderr io.Writer)
 	return &jobProcess{
 		jobHandle:     jobHandle,
 		processHandle: pi.Process,
+		pid:           int(pi.ProcessId),
 	}, wi, nil
 }
 
 type jobProcess struct {
 	jobHandle     syscall.Handle
 	processHandle syscall.Handle
+	pid           int
 }
 
 func (process *jobProcess) Signal(garden.Signal) error {
@@ -192,6 +194,10 @@ func (process *jobProcess) Wait() (int, error) {
 	return int(ec), nil
 }
 
+func (process *jobProcess) Pid() int {
+	return process.pid
+}
+
 func (process *jobProcess) SetWindowSize(garden.WindowSize) error {
 	return nil
 }
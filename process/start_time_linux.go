@@ -0,0 +1,68 @@
+package process
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// USER_HZ, which /proc reports times in, is 100 on every platform Linux
+// supports
+const clockTicks = 100
+
+func startTime(pid int) (time.Time, error) {
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	// skip past the command name, which may contain spaces
+	fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+	if len(fields) < 20 {
+		return time.Time{}, fmt.Errorf("malformed stat for process %d", pid)
+	}
+
+	// starttime is the 22nd field; fields[0] is the 3rd
+	ticks, err := strconv.ParseUint(fields[19], 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	boot, err := bootTime()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return boot.Add(time.Duration(ticks) * time.Second / clockTicks), nil
+}
+
+func bootTime() (time.Time, error) {
+	stat, err := os.Open("/proc/stat")
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	defer stat.Close()
+
+	scanner := bufio.NewScanner(stat)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "btime" {
+			secs, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return time.Time{}, err
+			}
+
+			return time.Unix(secs, 0), nil
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return time.Time{}, err
+	}
+
+	return time.Time{}, fmt.Errorf("btime not found in /proc/stat")
+}
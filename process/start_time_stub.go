@@ -0,0 +1,12 @@
+// +build !linux,!darwin,!windows
+
+package process
+
+import (
+	"errors"
+	"time"
+)
+
+func startTime(pid int) (time.Time, error) {
+	return time.Time{}, errors.New("cannot determine process start time on this platform")
+}
@@ -0,0 +1,24 @@
+package process
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+func startTime(pid int) (time.Time, error) {
+	handle, err := syscall.OpenProcess(syscall.PROCESS_QUERY_INFORMATION, false, uint32(pid))
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	defer syscall.CloseHandle(handle)
+
+	var u syscall.Rusage
+	err = syscall.GetProcessTimes(handle, &u.CreationTime, &u.ExitTime, &u.KernelTime, &u.UserTime)
+	if err != nil {
+		return time.Time{}, os.NewSyscallError("GetProcessTimes", err)
+	}
+
+	return time.Unix(0, u.CreationTime.Nanoseconds()), nil
+}
@@ -0,0 +1,83 @@
+package process
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrUsageUnsupported is returned when process usage cannot be sampled on
+// this platform.
+var ErrUsageUnsupported = errors.New("process usage is not supported on this platform")
+
+// Usage is the combined resource usage of a set of processes and all of
+// their descendants.
+type Usage struct {
+	Processes uint64
+
+	CPUUser   time.Duration
+	CPUSystem time.Duration
+
+	// resident set size, in bytes
+	Memory uint64
+}
+
+type procInfo struct {
+	pid  int
+	ppid int
+
+	user   time.Duration
+	system time.Duration
+	rss    uint64
+}
+
+// TreeUsage samples the usage of the given processes and their descendants.
+func TreeUsage(pids []int) (Usage, error) {
+	var usage Usage
+
+	err := walkTree(pids, func(proc procInfo) {
+		usage.Processes++
+		usage.CPUUser += proc.user
+		usage.CPUSystem += proc.system
+		usage.Memory += proc.rss
+	})
+	if err != nil {
+		return Usage{}, err
+	}
+
+	return usage, nil
+}
+
+// walkTree visits the given processes and all of their descendants.
+func walkTree(pids []int, visit func(procInfo)) error {
+	procs, err := listProcesses()
+	if err != nil {
+		return err
+	}
+
+	byPid := map[int]procInfo{}
+	children := map[int][]int{}
+	for _, proc := range procs {
+		byPid[proc.pid] = proc
+		children[proc.ppid] = append(children[proc.ppid], proc.pid)
+	}
+
+	seen := map[int]bool{}
+	queue := append([]int{}, pids...)
+	for len(queue) > 0 {
+		pid := queue[0]
+		queue = queue[1:]
+
+		proc, found := byPid[pid]
+		if !found || seen[pid] {
+			continue
+		}
+
+		seen[pid] = true
+
+		visit(proc)
+
+		queue = append(queue, children[pid]...)
+	}
+
+	return nil
+}
@@ -0,0 +1,55 @@
+package process
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func listProcesses() ([]procInfo, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+
+	pageSize := uint64(os.Getpagesize())
+
+	procs := []procInfo{}
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+
+		stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+		if err != nil {
+			// exited in the meantime
+			continue
+		}
+
+		// skip past the command name, which may contain spaces; fields[0] is
+		// then the 3rd field of the stat line
+		fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+		if len(fields) < 22 {
+			continue
+		}
+
+		ppid, _ := strconv.Atoi(fields[1])
+		utime, _ := strconv.ParseUint(fields[11], 10, 64)
+		stime, _ := strconv.ParseUint(fields[12], 10, 64)
+		rss, _ := strconv.ParseUint(fields[21], 10, 64)
+
+		procs = append(procs, procInfo{
+			pid:  pid,
+			ppid: ppid,
+
+			user:   time.Duration(utime) * time.Second / clockTicks,
+			system: time.Duration(stime) * time.Second / clockTicks,
+			rss:    rss * pageSize,
+		})
+	}
+
+	return procs, nil
+}
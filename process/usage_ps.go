@@ -0,0 +1,74 @@
+// +build !linux,!windows
+
+package process
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// there's no /proc to read from, so ask ps
+func listProcesses() ([]procInfo, error) {
+	output, err := exec.Command("ps", "-A", "-o", "pid=,ppid=,rss=,utime=,time=").Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list processes: %s", err)
+	}
+
+	procs := []procInfo{}
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 5 {
+			continue
+		}
+
+		pid, err := strconv.Atoi(fields[0])
+		if err != nil {
+			continue
+		}
+
+		ppid, _ := strconv.Atoi(fields[1])
+		rss, _ := strconv.ParseUint(fields[2], 10, 64)
+		user, _ := parseCPUTime(fields[3])
+		total, _ := parseCPUTime(fields[4])
+
+		procs = append(procs, procInfo{
+			pid:  pid,
+			ppid: ppid,
+
+			user:   user,
+			system: total - user,
+			rss:    rss * 1024,
+		})
+	}
+
+	return procs, nil
+}
+
+// parseCPUTime parses ps's [[dd-]hh:]mm:ss[.cc] format.
+func parseCPUTime(str string) (time.Duration, error) {
+	var days int
+	if i := strings.Index(str, "-"); i != -1 {
+		var err error
+		days, err = strconv.Atoi(str[:i])
+		if err != nil {
+			return 0, err
+		}
+
+		str = str[i+1:]
+	}
+
+	var total time.Duration
+	for _, segment := range strings.Split(str, ":") {
+		secs, err := strconv.ParseFloat(segment, 64)
+		if err != nil {
+			return 0, err
+		}
+
+		total = total*60 + time.Duration(secs*float64(time.Second))
+	}
+
+	return total + time.Duration(days)*24*time.Hour, nil
+}
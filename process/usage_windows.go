@@ -0,0 +1,5 @@
+package process
+
+func listProcesses() ([]procInfo, error) {
+	return nil, ErrUsageUnsupported
+}
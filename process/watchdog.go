@@ -0,0 +1,193 @@
+package process
+
+import (
+	"sync"
+	"time"
+)
+
+// WatchdogLimits are the limits a Watchdog enforces. Zero means no limit.
+type WatchdogLimits struct {
+	// resident set size, in bytes
+	Memory uint64
+
+	// how many CPUs' worth of time may be used, e.g. 0.5
+	CPU float64
+}
+
+// Violation is a limit a Watchdog found to be exceeded, described as the
+// event it results in.
+type Violation string
+
+const (
+	ViolationMemory Violation = "out of memory"
+	ViolationCPU    Violation = "cpu limit exceeded"
+	ViolationDisk   Violation = "disk limit exceeded"
+)
+
+// Watchdog enforces memory and CPU limits on a tracker's processes where
+// nothing else can, by sampling the usage of the processes and their
+// descendants every interval, and killing them all when it's over a limit, or
+// when any of its other checks fail.
+//
+// CPU time is measured between samples, so processes are only killed for
+// using too much of it for a whole interval.
+type Watchdog struct {
+	tracker  ProcessTracker
+	interval time.Duration
+
+	limits   func() WatchdogLimits
+	violated func(Violation)
+
+	// limits on anything besides the processes' usage, e.g. disk
+	checks []watchdogCheck
+
+	started bool
+	stopped bool
+	stateL  sync.Mutex
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// NewWatchdog returns a Watchdog for the tracker's processes, which checks
+// the current limits every interval and calls violated whenever it kills them.
+func NewWatchdog(tracker ProcessTracker, interval time.Duration, limits func() WatchdogLimits, violated func(Violation)) *Watchdog {
+	return &Watchdog{
+		tracker:  tracker,
+		interval: interval,
+
+		limits:   limits,
+		violated: violated,
+
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+}
+
+// watchdogCheck is a check that is made every so many of the watchdog's
+// intervals.
+type watchdogCheck struct {
+	check func() Violation
+	every int
+}
+
+// Check has the watchdog also kill the processes whenever check, which is
+// called every interval (rounded up to a multiple of the watchdog's own),
+// returns a violation. Checks that are expensive to make can be given a longer
+// interval than the watchdog's. It must be called before Start.
+func (watchdog *Watchdog) Check(interval time.Duration, check func() Violation) {
+	every := int((interval + watchdog.interval - 1) / watchdog.interval)
+	if every < 1 {
+		every = 1
+	}
+
+	watchdog.checks = append(watchdog.checks, watchdogCheck{
+		check: check,
+		every: every,
+	})
+}
+
+// Start starts watching in the background.
+func (watchdog *Watchdog) Start() {
+	watchdog.stateL.Lock()
+	defer watchdog.stateL.Unlock()
+
+	if watchdog.started || watchdog.stopped {
+		return
+	}
+
+	watchdog.started = true
+
+	go watchdog.watch()
+}
+
+// Stop stops watching, and waits for any check in progress to finish. It may
+// be called more than once, and whether or not the watchdog was started.
+func (watchdog *Watchdog) Stop() {
+	watchdog.stateL.Lock()
+
+	if !watchdog.stopped {
+		watchdog.stopped = true
+		close(watchdog.stop)
+	}
+
+	started := watchdog.started
+
+	watchdog.stateL.Unlock()
+
+	if started {
+		<-watchdog.done
+	}
+}
+
+func (watchdog *Watchdog) watch() {
+	defer close(watchdog.done)
+
+	ticker := time.NewTicker(watchdog.interval)
+	defer ticker.Stop()
+
+	// the CPU time used as of the last sample, if there was one
+	var lastCPU time.Duration
+	var lastSampled time.Time
+
+	usageSupported := true
+
+	for tick := 1; ; tick++ {
+		select {
+		case <-watchdog.stop:
+			return
+		case <-ticker.C:
+		}
+
+		var violation Violation
+
+		limits := watchdog.limits()
+		if usageSupported && (limits.Memory != 0 || limits.CPU != 0) {
+			usage, err := watchdog.tracker.Usage()
+			if err == ErrUsageUnsupported {
+				// nothing can be enforced from the processes' usage here
+				usageSupported = false
+			} else if err == nil {
+				now := time.Now()
+				cpu := usage.CPUUser + usage.CPUSystem
+
+				if limits.Memory != 0 && usage.Memory > limits.Memory {
+					violation = ViolationMemory
+				} else if limits.CPU != 0 && !lastSampled.IsZero() && cpu > lastCPU {
+					allowed := time.Duration(float64(now.Sub(lastSampled)) * limits.CPU)
+					if cpu-lastCPU > allowed {
+						violation = ViolationCPU
+					}
+				}
+
+				lastCPU = cpu
+				lastSampled = now
+			}
+		} else {
+			lastSampled = time.Time{}
+		}
+
+		for _, check := range watchdog.checks {
+			if violation != "" {
+				break
+			}
+
+			if tick%check.every != 0 {
+				continue
+			}
+
+			violation = check.check()
+		}
+
+		if violation == "" {
+			continue
+		}
+
+		// report it first, so that it's known of by the time they're dead
+		watchdog.violated(violation)
+
+		_ = watchdog.tracker.Kill()
+
+		// whatever replaces them starts from scratch
+		lastSampled = time.Time{}
+	}
+}
@@ -0,0 +1,193 @@
+package houdini
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/concourse/go-archive/tarfs"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	compressionNone = ""
+	compressionGzip = "gzip"
+	compressionZstd = "zstd"
+)
+
+// extractRootfs unpacks a .tar, .tgz or .tar.zst archive on the host into
+// dest.
+func extractRootfs(archive string, dest string) error {
+	var compression string
+	switch {
+	case strings.HasSuffix(archive, ".tar"):
+		compression = compressionNone
+	case strings.HasSuffix(archive, ".tgz"), strings.HasSuffix(archive, ".tar.gz"):
+		compression = compressionGzip
+	case strings.HasSuffix(archive, ".tar.zst"), strings.HasSuffix(archive, ".tzst"):
+		compression = compressionZstd
+	default:
+		return fmt.Errorf("unsupported rootfs archive (must be .tar, .tgz or .tar.zst): %s", archive)
+	}
+
+	file, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	stream, err := decompress(file, compression)
+	if err != nil {
+		return err
+	}
+
+	defer stream.Close()
+
+	return tarfs.Extract(stream, dest)
+}
+
+func decompress(r io.Reader, compression string) (io.ReadCloser, error) {
+	switch compression {
+	case compressionNone:
+		return io.NopCloser(r), nil
+
+	case compressionGzip:
+		return gzip.NewReader(r)
+
+	case compressionZstd:
+		zst, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+
+		return zst.IOReadCloser(), nil
+
+	default:
+		return nil, fmt.Errorf("unsupported compression: %s", compression)
+	}
+}
+
+// copyRootfs copies the rootfs at src to dest, for when it can't be mounted.
+// Files are copied byte for byte, or cloned where the filesystem supports it,
+// so that changing the copy never changes src; files hardlinked to each other
+// in src are hardlinked to each other in the copy.
+func copyRootfs(src string, dest string) error {
+	linked := map[fileID]string{}
+
+	return filepath.WalkDir(src, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+
+		target := filepath.Join(dest, rel)
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case entry.IsDir():
+			err := os.MkdirAll(target, 0755)
+			if err != nil {
+				return err
+			}
+
+			err = copyOwner(info, target)
+			if err != nil {
+				return err
+			}
+
+			// after chown, which clears setuid and setgid bits
+			return os.Chmod(target, info.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky))
+
+		case entry.Type()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+
+			err = os.Symlink(link, target)
+			if err != nil {
+				return err
+			}
+
+			return copyOwner(info, target)
+
+		case entry.Type().IsRegular():
+			id, ok := fileIDOf(info)
+			if ok {
+				first, found := linked[id]
+				if found {
+					return os.Link(first, target)
+				}
+
+				linked[id] = target
+			}
+
+			err := copyFile(path, target)
+			if err != nil {
+				return err
+			}
+
+			err = copyOwner(info, target)
+			if err != nil {
+				return err
+			}
+
+			// after chown, which clears setuid and setgid bits
+			err = os.Chmod(target, info.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky))
+			if err != nil {
+				return err
+			}
+
+			return os.Chtimes(target, info.ModTime(), info.ModTime())
+
+		default:
+			err := copySpecialFile(info, target)
+			if err != nil {
+				return err
+			}
+
+			return copyOwner(info, target)
+		}
+	})
+}
+
+// copyFile copies the content of the file at src to a new file at dest,
+// cloning it if the filesystem can.
+func copyFile(src string, dest string) error {
+	if cloneFile(src, dest) == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+
+	defer in.Close()
+
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
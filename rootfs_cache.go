@@ -0,0 +1,407 @@
+package houdini
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/charlievieth/fs"
+)
+
+// the cache lives alongside the containers in the depot; container IDs never
+// contain a dash, so it can't be mistaken for one
+const rootfsCacheDirName = "rootfs-cache"
+
+// DefaultRootfsCacheSize is how much disk the rootfs cache may use before it
+// starts evicting unused rootfses, unless configured otherwise.
+const DefaultRootfsCacheSize = 10 * 1024 * 1024 * 1024
+
+// rootfsCache holds unpacked rootfses, keyed by the digest of the tarball or
+// image manifest they were unpacked from, so that each is only unpacked once.
+//
+// Each entry is a directory holding the unpacked rootfs, its size, and a
+// marker file for every container using it. Entries that no container is
+// using are evicted, least recently used first, once the cache grows beyond
+// its max size.
+type rootfsCache struct {
+	logger lager.Logger
+
+	dir     string
+	maxSize uint64
+
+	// held while unpacking, referencing or removing an entry
+	entryLocks  map[string]*sync.Mutex
+	entryLocksL sync.Mutex
+
+	// held while evicting
+	evictL sync.Mutex
+}
+
+type rootfsCacheEntry struct {
+	key      string
+	dir      string
+	size     uint64
+	refs     int
+	lastUsed time.Time
+}
+
+func newRootfsCache(logger lager.Logger, dir string, maxSize uint64) *rootfsCache {
+	return &rootfsCache{
+		logger: logger,
+
+		dir:     dir,
+		maxSize: maxSize,
+
+		entryLocks: map[string]*sync.Mutex{},
+	}
+}
+
+// Acquire returns the path to the rootfs for key, calling unpack to unpack it
+// into a directory if it isn't cached yet, and records that the container id
+// is using it.
+func (cache *rootfsCache) Acquire(key string, id string, unpack func(string) error) (string, error) {
+	entryDir, err := cache.entryDir(key)
+	if err != nil {
+		return "", err
+	}
+
+	lock := cache.entryLock(key)
+	lock.Lock()
+
+	unpacked, err := cache.acquire(entryDir, id, unpack)
+
+	lock.Unlock()
+
+	if err != nil {
+		return "", err
+	}
+
+	if unpacked {
+		cache.Evict()
+	}
+
+	return filepath.Join(entryDir, "rootfs"), nil
+}
+
+func (cache *rootfsCache) acquire(entryDir string, id string, unpack func(string) error) (bool, error) {
+	var unpacked bool
+
+	_, err := os.Stat(entryDir)
+	if os.IsNotExist(err) {
+		err := cache.unpack(entryDir, unpack)
+		if err != nil {
+			return false, err
+		}
+
+		unpacked = true
+	} else if err != nil {
+		return false, err
+	}
+
+	err = os.WriteFile(filepath.Join(entryDir, "refs", id), nil, 0644)
+	if err != nil {
+		return false, err
+	}
+
+	return unpacked, touch(entryDir)
+}
+
+// unpack unpacks into a temporary directory first, so that a crash never
+// leaves a partially unpacked entry behind.
+func (cache *rootfsCache) unpack(entryDir string, unpack func(string) error) error {
+	err := os.MkdirAll(cache.dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	tmpDir, err := os.MkdirTemp(cache.dir, "tmp-")
+	if err != nil {
+		return err
+	}
+
+	err = unpack(filepath.Join(tmpDir, "rootfs"))
+	if err == nil {
+		err = cache.finishUnpacking(tmpDir, entryDir)
+	}
+
+	if err != nil {
+		_ = fs.RemoveAll(tmpDir)
+		return err
+	}
+
+	return nil
+}
+
+func (cache *rootfsCache) finishUnpacking(tmpDir string, entryDir string) error {
+	size, _, err := diskUsage(filepath.Join(tmpDir, "rootfs"))
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(filepath.Join(tmpDir, "size"), []byte(strconv.FormatUint(size, 10)), 0644)
+	if err != nil {
+		return err
+	}
+
+	err = os.Mkdir(filepath.Join(tmpDir, "refs"), 0755)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpDir, entryDir)
+}
+
+// Release records that the container id no longer uses the rootfs for key.
+func (cache *rootfsCache) Release(key string, id string) error {
+	entryDir, err := cache.entryDir(key)
+	if err != nil {
+		return err
+	}
+
+	lock := cache.entryLock(key)
+	lock.Lock()
+
+	err = os.Remove(filepath.Join(entryDir, "refs", id))
+	if err == nil {
+		err = touch(entryDir)
+	}
+
+	lock.Unlock()
+
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	cache.Evict()
+
+	return nil
+}
+
+// Prune forgets about any containers using the cache that aren't in ids, and
+// removes anything left over from unpacking that never finished.
+func (cache *rootfsCache) Prune(ids map[string]bool) error {
+	entries, err := os.ReadDir(cache.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	for _, entry := range entries {
+		entryDir := filepath.Join(cache.dir, entry.Name())
+
+		if strings.HasPrefix(entry.Name(), "tmp-") {
+			err := fs.RemoveAll(entryDir)
+			if err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		refs, err := os.ReadDir(filepath.Join(entryDir, "refs"))
+		if err != nil {
+			return err
+		}
+
+		for _, ref := range refs {
+			if ids[ref.Name()] {
+				continue
+			}
+
+			err := os.Remove(filepath.Join(entryDir, "refs", ref.Name()))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+
+	cache.Evict()
+
+	return nil
+}
+
+// Evict removes unused entries, least recently used first, until the cache
+// fits in its max size.
+func (cache *rootfsCache) Evict() {
+	cache.evictL.Lock()
+	defer cache.evictL.Unlock()
+
+	logger := cache.logger.Session("evict")
+
+	entries, err := cache.entries()
+	if err != nil {
+		logger.Error("failed-to-list-entries", err)
+		return
+	}
+
+	var total uint64
+	for _, entry := range entries {
+		total += entry.size
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].lastUsed.Before(entries[j].lastUsed)
+	})
+
+	for _, entry := range entries {
+		if total <= cache.maxSize {
+			break
+		}
+
+		if entry.refs > 0 {
+			continue
+		}
+
+		removed, err := cache.remove(entry)
+		if err != nil {
+			logger.Error("failed-to-remove-entry", err, lager.Data{"key": entry.key})
+			continue
+		}
+
+		if removed {
+			logger.Info("removed", lager.Data{"key": entry.key, "size": entry.size})
+			total -= entry.size
+		}
+	}
+}
+
+// remove removes an entry, unless a container started using it in the
+// meantime.
+func (cache *rootfsCache) remove(entry rootfsCacheEntry) (bool, error) {
+	lock := cache.entryLock(entry.key)
+	lock.Lock()
+	defer lock.Unlock()
+
+	refs, err := os.ReadDir(filepath.Join(entry.dir, "refs"))
+	if err != nil {
+		return false, err
+	}
+
+	if len(refs) > 0 {
+		return false, nil
+	}
+
+	// rename it out of the way first, so that it is never seen half-removed
+	tmpDir, err := os.MkdirTemp(cache.dir, "tmp-")
+	if err != nil {
+		return false, err
+	}
+
+	doomed := filepath.Join(tmpDir, "entry")
+
+	err = os.Rename(entry.dir, doomed)
+	if err != nil {
+		_ = os.Remove(tmpDir)
+		return false, err
+	}
+
+	return true, fs.RemoveAll(tmpDir)
+}
+
+func (cache *rootfsCache) entries() ([]rootfsCacheEntry, error) {
+	dirs, err := os.ReadDir(cache.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	entries := []rootfsCacheEntry{}
+	for _, dir := range dirs {
+		if strings.HasPrefix(dir.Name(), "tmp-") {
+			continue
+		}
+
+		entryDir := filepath.Join(cache.dir, dir.Name())
+
+		info, err := os.Stat(entryDir)
+		if err != nil {
+			return nil, err
+		}
+
+		sizePayload, err := os.ReadFile(filepath.Join(entryDir, "size"))
+		if err != nil {
+			return nil, err
+		}
+
+		size, err := strconv.ParseUint(string(sizePayload), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		refs, err := os.ReadDir(filepath.Join(entryDir, "refs"))
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, rootfsCacheEntry{
+			key:      strings.Replace(dir.Name(), "-", ":", 1),
+			dir:      entryDir,
+			size:     size,
+			refs:     len(refs),
+			lastUsed: info.ModTime(),
+		})
+	}
+
+	return entries, nil
+}
+
+func (cache *rootfsCache) entryDir(key string) (string, error) {
+	match := ociDigestPattern.FindStringSubmatch(key)
+	if match == nil {
+		return "", fmt.Errorf("invalid rootfs cache key: %q", key)
+	}
+
+	return filepath.Join(cache.dir, match[1]+"-"+match[2]), nil
+}
+
+func (cache *rootfsCache) entryLock(key string) *sync.Mutex {
+	cache.entryLocksL.Lock()
+	defer cache.entryLocksL.Unlock()
+
+	lock, found := cache.entryLocks[key]
+	if !found {
+		lock = new(sync.Mutex)
+		cache.entryLocks[key] = lock
+	}
+
+	return lock
+}
+
+// fileDigest computes the digest of a file, for use as a cache key.
+func fileDigest(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+
+	defer file.Close()
+
+	h := sha256.New()
+
+	_, err = io.Copy(h, file)
+	if err != nil {
+		return "", err
+	}
+
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func touch(path string) error {
+	now := time.Now()
+	return os.Chtimes(path, now, now)
+}
@@ -0,0 +1,244 @@
+package houdini
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/garden"
+	"github.com/charlievieth/fs"
+)
+
+// RootFSProvider provides containers with their rootfs, for rootfs URIs with
+// the scheme it is registered for.
+type RootFSProvider interface {
+	// Create provides the rootfs for a container that is being created.
+	Create(RootFSSpec) (RootFS, error)
+
+	// Destroy cleans up after the rootfs of a container that is being
+	// destroyed. It is also called for containers that failed to be created, and
+	// again if a destroy is retried, so it must tolerate the rootfs being gone.
+	Destroy(RootFSSpec) error
+}
+
+// RootFSSpec describes the rootfs a container is asking for.
+type RootFSSpec struct {
+	// ID is the ID of the container.
+	ID string
+
+	// URI is the container's rootfs URI.
+	URI *url.URL
+
+	// Properties are the container's properties.
+	Properties garden.Properties
+
+	// Dir is a directory in the depot for the provider's own use, e.g. for an
+	// unpacked rootfs. It is created before Create, and anything left in it is
+	// removed after Destroy.
+	Dir string
+}
+
+// RootFS is a rootfs provided for a container.
+type RootFS struct {
+	// Path is where the rootfs is on the host.
+	Path string
+
+	// Env, Dir and User are defaults for the container's processes, e.g. from
+	// an image's config.
+	Env  []string
+	Dir  string
+	User string
+}
+
+// WithRootFSProvider has rootfs URIs with the given scheme provided by
+// provider, replacing any built-in provider for the scheme.
+func WithRootFSProvider(scheme string, provider RootFSProvider) BackendOption {
+	return func(backend *Backend) {
+		backend.rootfsProviders[scheme] = provider
+	}
+}
+
+// where an overlay's changes go, within a provider's dir; the container reports
+// it as the disk it uses exclusively
+const overlayUpperDir = "upper"
+
+// rawRootFSProvider uses a directory on the host as the rootfs, in place or
+// through an overlay.
+type rawRootFSProvider struct {
+	// overlay every raw rootfs, not just for containers that ask for it
+	overlay bool
+}
+
+func (provider rawRootFSProvider) Create(spec RootFSSpec) (RootFS, error) {
+	if !provider.overlay && spec.Properties[OverlayProperty] != "true" {
+		return RootFS{Path: spec.URI.Path}, nil
+	}
+
+	merged, err := mountOverlay(spec.URI.Path, spec.Dir)
+	if err != nil {
+		return RootFS{}, err
+	}
+
+	return RootFS{Path: merged}, nil
+}
+
+func (provider rawRootFSProvider) Destroy(spec RootFSSpec) error {
+	return unmountBeneath(spec.Dir)
+}
+
+// cachedRootFSProvider gives each container its own copy of a rootfs that is
+// unpacked once into the cache, by mounting an overlay of it or, where that
+// isn't possible, copying it.
+type cachedRootFSProvider struct {
+	cache *rootfsCache
+
+	// resolve determines the cache key for a rootfs URI, how to unpack its
+	// rootfs, and any defaults it has for processes
+	resolve func(*url.URL) (string, func(string) error, RootFS, error)
+}
+
+// the cache key a container's rootfs came from, within the provider's dir
+const rootfsKeyFileName = "key"
+
+func (provider cachedRootFSProvider) Create(spec RootFSSpec) (RootFS, error) {
+	key, unpack, rootfs, err := provider.resolve(spec.URI)
+	if err != nil {
+		return RootFS{}, err
+	}
+
+	// record the key first, so that the reference is released even if the
+	// rest fails
+	err = os.WriteFile(filepath.Join(spec.Dir, rootfsKeyFileName), []byte(key), 0644)
+	if err != nil {
+		return RootFS{}, err
+	}
+
+	cached, err := provider.cache.Acquire(key, spec.ID, unpack)
+	if err != nil {
+		return RootFS{}, err
+	}
+
+	rootfs.Path, err = mountOverlay(cached, spec.Dir)
+	if err != nil {
+		// an empty upper dir would make the copy look like it's shared
+		err := fs.RemoveAll(filepath.Join(spec.Dir, overlayUpperDir))
+		if err != nil {
+			return RootFS{}, err
+		}
+
+		rootfs.Path = filepath.Join(spec.Dir, "copy")
+
+		err = copyRootfs(cached, rootfs.Path)
+		if err != nil {
+			return RootFS{}, err
+		}
+	}
+
+	return rootfs, nil
+}
+
+func (provider cachedRootFSProvider) Destroy(spec RootFSSpec) error {
+	err := unmountBeneath(spec.Dir)
+	if err != nil {
+		return err
+	}
+
+	key, err := os.ReadFile(filepath.Join(spec.Dir, rootfsKeyFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	return provider.cache.Release(string(key), spec.ID)
+}
+
+// archiveResolver resolves rootfs archives, remembering their digests so that
+// an archive is only hashed again once it changes.
+type archiveResolver struct {
+	digests  map[string]archiveDigest
+	digestsL sync.Mutex
+}
+
+// archiveDigest is the digest of an archive, as of when it had the given size
+// and modification time.
+type archiveDigest struct {
+	size    int64
+	modTime time.Time
+	digest  string
+}
+
+func newArchiveResolver() *archiveResolver {
+	return &archiveResolver{
+		digests: map[string]archiveDigest{},
+	}
+}
+
+func (resolver *archiveResolver) resolve(uri *url.URL) (string, func(string) error, RootFS, error) {
+	archive := uri.Path
+
+	key, err := resolver.digest(archive)
+	if err != nil {
+		return "", nil, RootFS{}, err
+	}
+
+	unpack := func(dest string) error {
+		return extractRootfs(archive, dest)
+	}
+
+	return key, unpack, RootFS{}, nil
+}
+
+func (resolver *archiveResolver) digest(archive string) (string, error) {
+	// stat before hashing, so that a change made while hashing is noticed next
+	// time
+	info, err := os.Stat(archive)
+	if err != nil {
+		return "", err
+	}
+
+	resolver.digestsL.Lock()
+	known, found := resolver.digests[archive]
+	resolver.digestsL.Unlock()
+
+	if found && known.size == info.Size() && known.modTime.Equal(info.ModTime()) {
+		return known.digest, nil
+	}
+
+	digest, err := fileDigest(archive)
+	if err != nil {
+		return "", err
+	}
+
+	resolver.digestsL.Lock()
+	resolver.digests[archive] = archiveDigest{
+		size:    info.Size(),
+		modTime: info.ModTime(),
+		digest:  digest,
+	}
+	resolver.digestsL.Unlock()
+
+	return digest, nil
+}
+
+func resolveOCIImage(uri *url.URL) (string, func(string) error, RootFS, error) {
+	image, err := resolveImage(uri.Path)
+	if err != nil {
+		return "", nil, RootFS{}, err
+	}
+
+	config, err := image.Config()
+	if err != nil {
+		return "", nil, RootFS{}, err
+	}
+
+	return image.digest, image.Unpack, RootFS{
+		Env:  config.Env,
+		Dir:  config.WorkingDir,
+		User: config.User,
+	}, nil
+}
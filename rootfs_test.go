@@ -0,0 +1,68 @@
+package houdini_test
+
+import (
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/vito/houdini"
+)
+
+var _ = Describe("CopyRootfs", func() {
+	var cacheDir string
+
+	BeforeEach(func() {
+		var err error
+		cacheDir, err = os.MkdirTemp("", "cached-rootfs")
+		Expect(err).ToNot(HaveOccurred())
+
+		DeferCleanup(os.RemoveAll, cacheDir)
+
+		Expect(os.MkdirAll(filepath.Join(cacheDir, "etc"), 0755)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(cacheDir, "etc", "some-file"), []byte("hello"), 0644)).To(Succeed())
+		Expect(os.Link(filepath.Join(cacheDir, "etc", "some-file"), filepath.Join(cacheDir, "etc", "linked-file"))).To(Succeed())
+		Expect(os.Symlink("some-file", filepath.Join(cacheDir, "etc", "symlinked-file"))).To(Succeed())
+	})
+
+	copyOf := func() string {
+		dir, err := os.MkdirTemp("", "copied-rootfs")
+		Expect(err).ToNot(HaveOccurred())
+
+		DeferCleanup(os.RemoveAll, dir)
+
+		copied := filepath.Join(dir, "copy")
+		Expect(houdini.CopyRootfs(cacheDir, copied)).To(Succeed())
+
+		return copied
+	}
+
+	It("gives each copy files of its own, which can be changed in place", func() {
+		copy1 := copyOf()
+		copy2 := copyOf()
+
+		Expect(os.ReadFile(filepath.Join(copy1, "etc", "some-file"))).To(Equal([]byte("hello")))
+
+		file, err := os.OpenFile(filepath.Join(copy1, "etc", "some-file"), os.O_WRONLY, 0)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = file.Write([]byte("HELLO"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(file.Close()).To(Succeed())
+
+		Expect(os.ReadFile(filepath.Join(copy1, "etc", "some-file"))).To(Equal([]byte("HELLO")))
+		Expect(os.ReadFile(filepath.Join(copy2, "etc", "some-file"))).To(Equal([]byte("hello")))
+		Expect(os.ReadFile(filepath.Join(cacheDir, "etc", "some-file"))).To(Equal([]byte("hello")))
+	})
+
+	It("keeps hardlinks and symlinks within the copy", func() {
+		copied := copyOf()
+
+		Expect(os.WriteFile(filepath.Join(copied, "etc", "some-file"), []byte("changed"), 0644)).To(Succeed())
+
+		Expect(os.ReadFile(filepath.Join(copied, "etc", "linked-file"))).To(Equal([]byte("changed")))
+		Expect(os.ReadFile(filepath.Join(copied, "etc", "symlinked-file"))).To(Equal([]byte("changed")))
+		Expect(os.Readlink(filepath.Join(copied, "etc", "symlinked-file"))).To(Equal("some-file"))
+
+		Expect(os.ReadFile(filepath.Join(cacheDir, "etc", "linked-file"))).To(Equal([]byte("hello")))
+	})
+})
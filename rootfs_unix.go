@@ -0,0 +1,54 @@
+// +build !windows
+
+package houdini
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// copyOwner gives path the same owner as the file described by info, without
+// following symlinks. Only root can give files away, so otherwise files are
+// left owned by the server's user.
+func copyOwner(info os.FileInfo, path string) error {
+	if os.Getuid() != 0 {
+		return nil
+	}
+
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+
+	return os.Lchown(path, int(stat.Uid), int(stat.Gid))
+}
+
+// fileID identifies a file on the host, so that hardlinks to it can be told
+// apart from copies of it.
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+// fileIDOf returns the identity of the file described by info, if it has
+// other hardlinks to it worth keeping track of.
+func fileIDOf(info os.FileInfo) (fileID, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || stat.Nlink < 2 {
+		return fileID{}, false
+	}
+
+	return fileID{dev: uint64(stat.Dev), ino: uint64(stat.Ino)}, true
+}
+
+// copySpecialFile recreates the device, fifo or socket described by info at
+// path.
+func copySpecialFile(info os.FileInfo, path string) error {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fmt.Errorf("can't copy special file: %s", path)
+	}
+
+	return syscall.Mknod(path, uint32(stat.Mode), int(stat.Rdev))
+}
@@ -0,0 +1,23 @@
+package houdini
+
+import "os"
+
+// copyOwner gives path the same owner as the file described by info. Files
+// are owned by whoever creates them on Windows, so there's nothing to do.
+func copyOwner(info os.FileInfo, path string) error {
+	return nil
+}
+
+// fileID identifies a file on the host. Hardlinks aren't kept track of on
+// Windows, so there's never one to compare.
+type fileID struct{}
+
+func fileIDOf(info os.FileInfo) (fileID, bool) {
+	return fileID{}, false
+}
+
+// copySpecialFile recreates a special file. There are none worth recreating
+// on Windows.
+func copySpecialFile(info os.FileInfo, path string) error {
+	return nil
+}
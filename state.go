@@ -0,0 +1,101 @@
+package houdini
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"code.cloudfoundry.org/garden"
+)
+
+const stateFileName = "state.json"
+
+// containerState is everything needed to bring a container back after the
+// server restarts. It is written to the container's depot directory.
+type containerState struct {
+	Spec      garden.ContainerSpec `json:"spec"`
+	CreatedAt time.Time            `json:"created_at"`
+	WorkDir   string               `json:"work_dir"`
+	HasRootfs bool                 `json:"has_rootfs"`
+	Isolated  bool                 `json:"isolated,omitempty"`
+	Init      *containerInit       `json:"init,omitempty"`
+	Cgroup    string               `json:"cgroup,omitempty"`
+	Project   uint32               `json:"project,omitempty"`
+	Mounts    []string             `json:"mounts,omitempty"`
+	Lifecycle lifecycle            `json:"lifecycle"`
+
+	Properties garden.Properties `json:"properties"`
+	GraceTime  time.Duration     `json:"grace_time"`
+	Env        []string          `json:"env"`
+	Limits     *garden.Limits    `json:"limits,omitempty"`
+
+	DefaultDir  string `json:"default_dir,omitempty"`
+	DefaultUser string `json:"default_user,omitempty"`
+
+	Events      []string             `json:"events,omitempty"`
+	MappedPorts []garden.PortMapping `json:"mapped_ports,omitempty"`
+}
+
+func (container *container) saveState() error {
+	container.stateL.Lock()
+	defer container.stateL.Unlock()
+
+	limits := container.currentLimits()
+
+	payload, err := json.Marshal(containerState{
+		Spec:      container.spec,
+		CreatedAt: container.createdAt,
+		WorkDir:   container.workDir,
+		HasRootfs: container.hasRootfs,
+		Isolated:  container.isolated,
+		Init:      container.init,
+		Cgroup:    container.cgroupDir(),
+		Project:   container.quotaProject(),
+		Mounts:    container.currentMounts(),
+		Lifecycle: container.currentLifecycle(),
+
+		Properties: container.currentProperties(),
+		GraceTime:  container.currentGraceTime(),
+		Env:        container.env,
+		Limits:     &limits,
+
+		DefaultDir:  container.defaultDir,
+		DefaultUser: container.defaultUser,
+
+		Events:      container.currentEvents(),
+		MappedPorts: container.currentMappedPorts(),
+	})
+	if err != nil {
+		return err
+	}
+
+	stateFile := filepath.Join(container.dir, stateFileName)
+
+	// write to a temporary file first so that a crash never leaves a
+	// truncated state file behind
+	tmpFile := stateFile + ".tmp"
+
+	err = os.WriteFile(tmpFile, payload, 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile, stateFile)
+}
+
+func loadState(dir string) (containerState, error) {
+	var state containerState
+
+	payload, err := os.ReadFile(filepath.Join(dir, stateFileName))
+	if err != nil {
+		return state, err
+	}
+
+	err = json.Unmarshal(payload, &state)
+	if err != nil {
+		return state, err
+	}
+
+	return state, nil
+}
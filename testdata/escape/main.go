@@ -0,0 +1,41 @@
+// escape tries to break out of its rootfs the way one breaks out of a chroot,
+// and reports whether it could then see the file given as its argument.
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+func main() {
+	err := os.MkdirAll("/escape-dir", 0755)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	err = syscall.Chroot("/escape-dir")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	// the chroot doesn't move the working directory, which is outside of it
+	for i := 0; i < 100; i++ {
+		_ = syscall.Chdir("..")
+	}
+
+	err = syscall.Chroot(".")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	_, err = os.Stat(os.Args[1])
+	if err == nil {
+		fmt.Println("escaped")
+	} else {
+		fmt.Println("confined")
+	}
+}
@@ -0,0 +1,52 @@
+// hog uses up as many MiB of memory as it's given, with "cpu", as much CPU
+// time as it can, or with "disk", as many MiB of disk in the working
+// directory as it's given, until it's killed.
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+func main() {
+	if os.Args[1] == "cpu" {
+		for {
+		}
+	}
+
+	var memory []byte
+	if os.Args[1] == "disk" {
+		err := os.WriteFile("hog", make([]byte, mib(os.Args[2])), 0644)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	} else {
+		memory = make([]byte, mib(os.Args[1]))
+
+		// touch every page, so that it's resident
+		for i := 0; i < len(memory); i += os.Getpagesize() {
+			memory[i] = 1
+		}
+	}
+
+	for {
+		time.Sleep(time.Second)
+
+		if len(memory) > 0 {
+			memory[0]++
+		}
+	}
+}
+
+func mib(arg string) int {
+	n, err := strconv.Atoi(arg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	return n * 1024 * 1024
+}
@@ -0,0 +1,24 @@
+// whoami prints who it's running as and the environment that goes with it,
+// along with any other environment variables named by its arguments.
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+func main() {
+	groups, err := os.Getgroups()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("uid=%d gid=%d groups=%v\n", os.Getuid(), os.Getgid(), groups)
+
+	for _, name := range os.Args[1:] {
+		fmt.Printf("%s=%s\n", name, os.Getenv(name))
+	}
+
+	fmt.Printf("HOME=%s USER=%s PATH=%s\n", os.Getenv("HOME"), os.Getenv("USER"), os.Getenv("PATH"))
+}
@@ -0,0 +1,314 @@
+package houdini
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// processUser is who a process is run as.
+type processUser struct {
+	Name   string
+	Home   string
+	UID    uint32
+	GID    uint32
+	Groups []uint32
+}
+
+func (user *processUser) defaultPath() string {
+	if user == nil || user.UID == 0 {
+		return defaultRootPath
+	}
+
+	return defaultPath
+}
+
+func (user *processUser) credential() *syscall.Credential {
+	if user == nil {
+		return nil
+	}
+
+	return &syscall.Credential{
+		Uid:    user.UID,
+		Gid:    user.GID,
+		Groups: user.Groups,
+	}
+}
+
+// env is what a process's environment says about who it's running as, which
+// the container's and the process's own env may override.
+func (user *processUser) env() []string {
+	if user == nil {
+		return nil
+	}
+
+	return []string{
+		"HOME=" + user.Home,
+		"USER=" + user.Name,
+	}
+}
+
+// lookupUser resolves a user, given as a name or uid optionally followed by
+// ":" and a group name or gid, from the rootfs's /etc/passwd and /etc/group,
+// or from the host for containers without a rootfs. It returns nil for no
+// user, in which case processes run as the server's user.
+func (container *container) lookupUser(name string) (*processUser, error) {
+	if name == "" {
+		return nil, nil
+	}
+
+	userName, groupName, hasGroup := strings.Cut(name, ":")
+
+	var found *processUser
+	var err error
+	if container.hasRootfs {
+		found, err = container.lookupRootfsUser(userName)
+	} else {
+		found, err = lookupHostUser(userName)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if hasGroup {
+		if container.hasRootfs {
+			found.GID, err = container.lookupRootfsGroup(groupName)
+		} else {
+			found.GID, err = lookupHostGroup(groupName)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return found, nil
+}
+
+func (container *container) lookupRootfsUser(name string) (*processUser, error) {
+	uid, numeric := parseID(name)
+
+	passwd, err := container.readRootfsDatabase("/etc/passwd")
+	if err != nil {
+		return nil, err
+	}
+
+	var found *processUser
+	for _, fields := range passwd {
+		// name:password:uid:gid:gecos:home:shell
+		if len(fields) < 7 {
+			continue
+		}
+
+		entryUID, ok := parseID(fields[2])
+		if !ok {
+			continue
+		}
+
+		entryGID, ok := parseID(fields[3])
+		if !ok {
+			continue
+		}
+
+		if fields[0] == name || (numeric && entryUID == uid) {
+			found = &processUser{
+				Name: fields[0],
+				Home: fields[5],
+				UID:  entryUID,
+				GID:  entryGID,
+			}
+
+			break
+		}
+	}
+
+	if found == nil {
+		if !numeric {
+			return nil, fmt.Errorf("unknown user: %s", name)
+		}
+
+		// a uid needn't have an entry, as with images that don't ship any
+		return &processUser{
+			Name: name,
+			Home: "/",
+			UID:  uid,
+		}, nil
+	}
+
+	groups, err := container.readRootfsDatabase("/etc/group")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, fields := range groups {
+		// name:password:gid:members
+		if len(fields) < 4 {
+			continue
+		}
+
+		gid, ok := parseID(fields[2])
+		if !ok {
+			continue
+		}
+
+		for _, member := range strings.Split(fields[3], ",") {
+			if member == found.Name {
+				found.Groups = append(found.Groups, gid)
+				break
+			}
+		}
+	}
+
+	return found, nil
+}
+
+func (container *container) lookupRootfsGroup(name string) (uint32, error) {
+	if gid, ok := parseID(name); ok {
+		return gid, nil
+	}
+
+	groups, err := container.readRootfsDatabase("/etc/group")
+	if err != nil {
+		return 0, err
+	}
+
+	for _, fields := range groups {
+		if len(fields) < 3 || fields[0] != name {
+			continue
+		}
+
+		gid, ok := parseID(fields[2])
+		if ok {
+			return gid, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown group: %s", name)
+}
+
+// readRootfsDatabase reads the entries of a colon-separated database like
+// /etc/passwd from the rootfs, treating it as empty if it's missing. Symlinks
+// leading to it are resolved within the rootfs, but it's never read through a
+// symlink of its own, which could lead out of the rootfs.
+func (container *container) readRootfsDatabase(name string) ([][]string, error) {
+	path, err := resolveInRootfs(container.workDir, name)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Lstat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	if !info.Mode().IsRegular() {
+		return nil, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	entries := [][]string{}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		entries = append(entries, strings.Split(line, ":"))
+	}
+
+	return entries, scanner.Err()
+}
+
+func lookupHostUser(name string) (*processUser, error) {
+	var found *user.User
+	var err error
+	if _, numeric := parseID(name); numeric {
+		found, err = user.LookupId(name)
+	} else {
+		found, err = user.Lookup(name)
+	}
+
+	if err != nil {
+		if _, unknown := err.(user.UnknownUserIdError); unknown {
+			uid, _ := parseID(name)
+			return &processUser{Name: name, Home: "/", UID: uid}, nil
+		}
+
+		return nil, err
+	}
+
+	uid, ok := parseID(found.Uid)
+	if !ok {
+		return nil, fmt.Errorf("invalid uid for user %s: %s", name, found.Uid)
+	}
+
+	gid, ok := parseID(found.Gid)
+	if !ok {
+		return nil, fmt.Errorf("invalid gid for user %s: %s", name, found.Gid)
+	}
+
+	groupIDs, err := found.GroupIds()
+	if err != nil {
+		return nil, err
+	}
+
+	groups := []uint32{}
+	for _, groupID := range groupIDs {
+		group, ok := parseID(groupID)
+		if ok {
+			groups = append(groups, group)
+		}
+	}
+
+	return &processUser{
+		Name:   found.Username,
+		Home:   found.HomeDir,
+		UID:    uid,
+		GID:    gid,
+		Groups: groups,
+	}, nil
+}
+
+func lookupHostGroup(name string) (uint32, error) {
+	if gid, ok := parseID(name); ok {
+		return gid, nil
+	}
+
+	group, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, err
+	}
+
+	gid, ok := parseID(group.Gid)
+	if !ok {
+		return 0, fmt.Errorf("invalid gid for group %s: %s", name, group.Gid)
+	}
+
+	return gid, nil
+}
+
+func parseID(id string) (uint32, bool) {
+	n, err := strconv.ParseUint(id, 10, 32)
+	if err != nil {
+		return 0, false
+	}
+
+	return uint32(n), true
+}